@@ -1,14 +1,16 @@
 package api
 
 import (
-	"github.com/sirupsen/logrus"
 	"github.com/hectane/go-asyncserver"
+	"github.com/hectane/hectane/email"
 	"github.com/hectane/hectane/queue"
+	"github.com/sirupsen/logrus"
 
 	"crypto/tls"
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync"
 )
 
 // Request methods.
@@ -16,20 +18,44 @@ const (
 	head = "HEAD"
 	get  = "GET"
 	post = "POST"
+	del  = "DELETE"
 )
 
+// Paths that are accessed by email recipients using signed links rather than
+// by clients of the API.
+var publicPaths = map[string]bool{
+	email.UnsubscribePath: true,
+	email.OpenPath:        true,
+	email.ClickPath:       true,
+}
+
+// Error that is reported with a specific HTTP status code and headers.
+type statusError struct {
+	error
+	code    int
+	headers map[string]string
+}
+
 // HTTP API for managing a mail queue.
 type API struct {
-	config   *Config
-	log      *logrus.Entry
-	server   *server.AsyncServer
-	serveMux *http.ServeMux
-	queue    *queue.Queue
-	stopped  chan bool
+	m           sync.Mutex
+	config      *Config
+	log         *logrus.Entry
+	server      *server.AsyncServer
+	serveMux    *http.ServeMux
+	queue       *queue.Queue
+	keyLocks    keyLocks
+	eventHub    eventHub
+	stopped     chan bool
+	draining    bool
+	drain       chan bool
+	certificate *tls.Certificate
+	reload      func() error
 }
 
 // Create a handler that logs and validates requests as they come in. The
 // return value of the handler is assumed to be either an error or a map.
+// Errors are reported with a 200 status code unless they are a statusError.
 func (a *API) method(methods []string, handler func(r *http.Request) interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		foundMethod := false
@@ -39,8 +65,17 @@ func (a *API) method(methods []string, handler func(r *http.Request) interface{}
 			}
 		}
 		if foundMethod {
-			v := handler(r)
+			var (
+				v    = handler(r)
+				code = http.StatusOK
+			)
 			if err, ok := v.(error); ok {
+				if e, ok := err.(*statusError); ok {
+					code = e.code
+					for k, h := range e.headers {
+						w.Header().Set(k, h)
+					}
+				}
 				v = map[string]string{
 					"error": err.Error(),
 				}
@@ -48,7 +83,7 @@ func (a *API) method(methods []string, handler func(r *http.Request) interface{}
 			if data, err := json.Marshal(v); err == nil {
 				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
+				w.WriteHeader(code)
 				if r.Method != head {
 					w.Write(data)
 				}
@@ -70,10 +105,23 @@ func New(config *Config, queue *queue.Queue) *API {
 		serveMux: http.NewServeMux(),
 		queue:    queue,
 		stopped:  make(chan bool),
+		drain:    make(chan bool),
 	}
 	a.server.Handler = a
-	a.serveMux.HandleFunc("/v1/raw", a.method([]string{post}, a.raw))
-	a.serveMux.HandleFunc("/v1/send", a.method([]string{post}, a.send))
+	a.serveMux.HandleFunc("/v1/drain", a.method([]string{post}, a.startDrain))
+	a.serveMux.HandleFunc("/v1/raw", a.method([]string{post}, a.idempotent("raw", a.raw)))
+	a.serveMux.HandleFunc("/v1/attachments", a.method([]string{post, del}, a.attachments))
+	a.serveMux.HandleFunc("/v1/batch", a.method([]string{post}, a.idempotent("batch", a.batch)))
+	a.serveMux.HandleFunc("/v1/send", a.method([]string{post}, a.idempotent("send", a.send)))
+	a.serveMux.HandleFunc("/v1/reload", a.method([]string{post}, a.reloadConfig))
+	a.serveMux.HandleFunc("/v1/ready", a.method([]string{head, get}, a.ready))
+	a.serveMux.HandleFunc(email.UnsubscribePath, a.method([]string{post}, a.unsubscribe))
+	a.serveMux.HandleFunc(email.OpenPath, a.trackOpen)
+	a.serveMux.HandleFunc(email.ClickPath, a.trackClick)
+	a.serveMux.HandleFunc("/v1/tracking", a.method([]string{head, get}, a.tracking))
+	a.serveMux.HandleFunc("/v1/events", a.events)
+	a.serveMux.HandleFunc("/v1/templates", a.method([]string{head, get, post, del}, a.templates))
+	a.serveMux.HandleFunc("/v1/suppressions", a.method([]string{head, get, post, del}, a.suppressions))
 	a.serveMux.HandleFunc("/v1/status", a.method([]string{head, get}, a.status))
 	a.serveMux.HandleFunc("/v1/version", a.method([]string{head, get}, a.version))
 	return a
@@ -83,36 +131,137 @@ func New(config *Config, queue *queue.Queue) *API {
 // ensure that HTTP basic auth credentials were supplied if required.
 func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.log.Debugf("%s - %s %s", r.RemoteAddr, r.Method, r.RequestURI)
-	if a.config.Username != "" && a.config.Password != "" {
+	config := a.getConfig()
+	if config.Username != "" && config.Password != "" && !publicPaths[r.URL.Path] {
 		username, password, ok := r.BasicAuth()
-		if !ok || username != a.config.Username || password != a.config.Password {
+		if !ok || username != config.Username || password != config.Password {
 			w.Header().Set("WWW-Authenticate", "Basic realm=Hectane")
 			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 			return
 		}
 	}
-	if a.config.CORSOrigin != "" {
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
-		w.Header().Set("Access-Control-Allow-Origin", a.config.CORSOrigin)
+	if config.CORSOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	}
 	a.serveMux.ServeHTTP(w, r)
 }
 
+// Retrieve the current configuration.
+func (a *API) getConfig() *Config {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.config
+}
+
+// Retrieve the current TLS certificate.
+func (a *API) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.certificate, nil
+}
+
 // Start listening for new requests.
 func (a *API) Start() error {
-	if a.config.TLSCert != "" && a.config.TLSKey != "" {
-		c, err := tls.LoadX509KeyPair(a.config.TLSCert, a.config.TLSKey)
+	if a.config.tlsEnabled() {
+		c, err := a.config.loadCertificate()
 		if err != nil {
 			return err
 		}
+		a.certificate = c
 		a.server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{c},
+			GetCertificate: a.getCertificate,
+		}
+	}
+	if err := a.server.Start(); err != nil {
+		return err
+	}
+	if a.queue != nil {
+		go a.runExpiry()
+	}
+	return nil
+}
+
+// Validate the specified configuration and reload the TLS certificate from
+// disk, returning a function that applies them. Nothing is changed until the
+// function is called. The address cannot be changed and TLS cannot be enabled
+// or disabled while the API is running.
+func (a *API) PrepareReload(c *Config) (func(), error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var (
+		old = a.getConfig()
+		n   = *c
+	)
+	if n.Addr != old.Addr || n.tlsEnabled() != old.tlsEnabled() {
+		a.log.Warning("address and TLS cannot be changed without a restart")
+		n.Addr = old.Addr
+		n.TLSCert = old.TLSCert
+		n.TLSKey = old.TLSKey
+	}
+	var cert *tls.Certificate
+	if n.tlsEnabled() {
+		c, err := n.loadCertificate()
+		if err != nil {
+			return nil, err
 		}
+		cert = c
+	}
+	return func() {
+		a.m.Lock()
+		defer a.m.Unlock()
+		a.config = &n
+		a.certificate = cert
+		a.log.Info("configuration reloaded")
+	}, nil
+}
+
+// Apply the specified configuration.
+func (a *API) Reload(c *Config) error {
+	apply, err := a.PrepareReload(c)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Begin draining. New messages are refused and readiness is reported as false
+// but requests continue to be served until the API is stopped. The channel
+// returned by DrainRequested() is closed the first time this is called.
+func (a *API) Drain() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if !a.draining {
+		a.log.Info("draining")
+		a.draining = true
+		close(a.drain)
 	}
-	return a.server.Start()
+}
+
+// Determine whether the API is draining.
+func (a *API) isDraining() bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.draining
+}
+
+// Set the function used to reload the configuration of the application when
+// requested through the API.
+func (a *API) OnReload(f func() error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.reload = f
+}
+
+// Retrieve a channel that is closed when draining begins.
+func (a *API) DrainRequested() <-chan bool {
+	return a.drain
 }
 
 // Stop listening for new requests.
 func (a *API) Stop() {
 	a.server.Stop()
+	close(a.stopped)
 }
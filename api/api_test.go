@@ -2,9 +2,12 @@ package api
 
 import (
 	"github.com/hectane/go-attest"
+	"github.com/hectane/hectane/queue"
 
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"testing"
 )
 
@@ -28,6 +31,33 @@ func createServer(username, password string) (*API, *http.Request, error) {
 	return a, req, nil
 }
 
+// Create a queue in a temporary directory, returning it along with the
+// directory and a function that stops the queue and removes the directory.
+func createQueue(t *testing.T) (*queue.Queue, string, func()) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := queue.NewQueue(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		os.RemoveAll(d)
+		t.Fatal(err)
+	}
+	return q, d, func() {
+		q.Stop()
+		os.RemoveAll(d)
+	}
+}
+
+// Create an API with the specified configuration that uses a new queue. The
+// returned function must be called to clean up the queue.
+func createQueueAPI(t *testing.T, c *Config) (*API, *queue.Queue, func()) {
+	q, _, cleanup := createQueue(t)
+	return New(c, q), q, cleanup
+}
+
 func TestBasicAuth(t *testing.T) {
 	var (
 		username    = "test"
@@ -64,3 +94,55 @@ func TestShutdown(t *testing.T) {
 		t.Fatal("error expected")
 	}
 }
+
+func TestDrain(t *testing.T) {
+	a, req, err := createServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	req.URL.Path = "/v1/ready"
+	if err := attest.HttpStatusCode(req, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	a.Drain()
+	select {
+	case <-a.DrainRequested():
+	default:
+		t.Fatal("drain channel not closed")
+	}
+	if err := attest.HttpStatusCode(req, http.StatusServiceUnavailable); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrepareReload(t *testing.T) {
+	a, req, err := createServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	req.URL.Path = "/v1/version"
+	if _, err := a.PrepareReload(&Config{
+		Addr:    a.getConfig().Addr,
+		TLSCert: "missing.crt",
+		TLSKey:  "missing.key",
+	}); err == nil {
+		t.Fatal("error expected")
+	}
+	apply, err := a.PrepareReload(&Config{
+		Addr:     a.getConfig().Addr,
+		Username: "test",
+		Password: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attest.HttpStatusCode(req, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	apply()
+	if err := attest.HttpStatusCode(req, http.StatusUnauthorized); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	errUploadNotFound = errors.New("upload does not exist")
+	errUploadTooLarge = errors.New("upload exceeds the maximum size")
+)
+
+// Upload a file for use as an attachment. The request body is the content of
+// the file and is streamed to storage, up to the maximum upload size. The
+// filename is specified in the query string and the content type is taken
+// from the request.
+func (a *API) uploadAttachment(r *http.Request) interface{} {
+	if err := a.checkAccepting(); err != nil {
+		return err
+	}
+	u := &queue.Upload{
+		Filename:    r.URL.Query().Get("filename"),
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	body := http.MaxBytesReader(nil, r.Body, a.getConfig().maxUploadSize())
+	if err := a.queue.Storage.SaveUpload(u, body); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return &statusError{
+				error: errUploadTooLarge,
+				code:  http.StatusRequestEntityTooLarge,
+			}
+		}
+		return err
+	}
+	return u
+}
+
+// Upload or delete an attachment. An upload is deleted by specifying its ID
+// in the query string.
+func (a *API) attachments(r *http.Request) interface{} {
+	if r.Method == post {
+		return a.uploadAttachment(r)
+	}
+	if err := a.queue.Storage.DeleteUpload(r.URL.Query().Get("id")); err != nil {
+		if os.IsNotExist(err) {
+			return &statusError{
+				error: errUploadNotFound,
+				code:  http.StatusNotFound,
+			}
+		}
+		return badRequest(err)
+	}
+	return struct{}{}
+}
+
+// Retrieve the length of time that unused uploads are kept.
+func (a *API) uploadExpiry() time.Duration {
+	return time.Duration(a.getConfig().UploadExpiry) * time.Second
+}
+
+// Remove uploads that have not been used within the expiry period.
+func (a *API) expireUploads() {
+	expiry := a.uploadExpiry()
+	if expiry <= 0 {
+		return
+	}
+	n, err := a.queue.Storage.ExpireUploads(time.Now().Add(-expiry))
+	if err != nil {
+		a.log.Error(err.Error())
+	}
+	if n != 0 {
+		a.log.Infof("removed %d expired upload(s)", n)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	a, _, cleanup := createQueueAPI(t, &Config{})
+	defer cleanup()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(post, "/v1/attachments?filename=test.txt", strings.NewReader("test"))
+	r.Header.Set("Content-Type", "text/plain")
+	a.ServeHTTP(w, r)
+	var u queue.Upload
+	if err := json.NewDecoder(w.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID == "" || u.Filename != "test.txt" || u.ContentType != "text/plain" || u.Size != 4 {
+		t.Fatalf("unexpected upload %+v", u)
+	}
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(del, "/v1/attachments?id="+u.ID, nil))
+		if w.Code != code {
+			t.Fatalf("%d != %d", w.Code, code)
+		}
+	}
+}
+
+func TestAttachmentsMaxSize(t *testing.T) {
+	a, q, cleanup := createQueueAPI(t, &Config{
+		MaxUploadSize: 4,
+	})
+	defer cleanup()
+	for _, r := range []struct {
+		body string
+		code int
+	}{
+		{"test", http.StatusOK},
+		{"tests", http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(post, "/v1/attachments?filename=test.txt", strings.NewReader(r.body)))
+		if w.Code != r.code {
+			t.Fatalf("%d != %d", w.Code, r.code)
+		}
+	}
+	if _, bytes := q.Storage.Usage(); bytes != 4 {
+		t.Fatalf("%d != 4", bytes)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"github.com/hectane/hectane/email"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+var errBatchEmpty = errors.New("batch has no recipients")
+
+// Result for a single recipient of a batch.
+type batchResult struct {
+	MessageIDs []string `json:"message_ids"`
+	Suppressed []string `json:"suppressed"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Send an email to each recipient of a batch, rendering the template with the
+// recipient's data. Recipients that cannot be rendered or queued are reported
+// individually rather than failing the batch.
+func (a *API) batch(r *http.Request) interface{} {
+	if err := a.checkAccepting(); err != nil {
+		return err
+	}
+	var b email.Batch
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		return err
+	}
+	if err := b.Validate(); err != nil {
+		return badRequest(err)
+	}
+	if len(b.Recipients) == 0 {
+		return badRequest(errBatchEmpty)
+	}
+	t := b.InlineTemplate()
+	if b.Template != "" {
+		var err error
+		if t, err = a.loadTemplate(b.Template); err != nil {
+			return err
+		}
+	} else if err := t.Validate(); err != nil {
+		return badRequest(err)
+	}
+	b.Links = a.links()
+	release, err := b.ShareAttachments(a.queue.Storage)
+	if err != nil {
+		return err
+	}
+	defer release()
+	results := make([]*batchResult, len(b.Recipients))
+	for i, recipient := range b.Recipients {
+		result := &batchResult{
+			MessageIDs: []string{},
+			Suppressed: []string{},
+		}
+		results[i] = result
+		e, err := b.RecipientEmail(t, recipient)
+		if err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		messages, suppressed, err := e.Messages(a.queue.Storage)
+		if err != nil {
+			result.Error = err.Error()
+			continue
+		}
+		for _, m := range messages {
+			a.queue.Deliver(m)
+			result.MessageIDs = append(result.MessageIDs, m.ID())
+		}
+		result.Suppressed = append(result.Suppressed, suppressed...)
+	}
+	return map[string][]*batchResult{
+		"results": results,
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	a, q, cleanup := createQueueAPI(t, &Config{})
+	defer cleanup()
+	if _, err := q.Storage.Suppress("c@example.invalid", "test"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(post, "/v1/batch", strings.NewReader(`{
+		"from": "me@example.invalid",
+		"subject": "Hi {{.name}}",
+		"text": "{{.greeting}}, {{.name}}",
+		"data": {"greeting": "Hello"},
+		"recipients": [
+			{"to": ["a@example.invalid"], "data": {"name": "A"}},
+			{"to": ["b@example.invalid"]},
+			{"to": ["invalid"], "data": {"name": "B"}},
+			{"to": ["c@example.invalid"], "data": {"name": "C"}}
+		]
+	}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d != %d", w.Code, http.StatusOK)
+	}
+	var response struct {
+		Results []*batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	r := response.Results
+	if len(r) != 4 {
+		t.Fatalf("%d != 4", len(r))
+	}
+	if len(r[0].MessageIDs) != 1 || r[0].Error != "" {
+		t.Fatalf("unexpected result %+v", r[0])
+	}
+	if r[1].Error == "" || r[2].Error == "" {
+		t.Fatal("errors expected for missing data and invalid address")
+	}
+	if len(r[3].MessageIDs) != 0 || len(r[3].Suppressed) != 1 {
+		t.Fatalf("unexpected result %+v", r[3])
+	}
+	m, err := q.Storage.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("%d != 1", len(m))
+	}
+}
+
+func TestBatchAttachments(t *testing.T) {
+	q, d, cleanup := createQueue(t)
+	defer cleanup()
+	a := New(&Config{}, q)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(post, "/v1/batch", strings.NewReader(`{
+		"from": "me@example.invalid",
+		"subject": "Report",
+		"text": "Attached",
+		"attachments": [{"filename": "report.txt", "content": "quarterly report"}],
+		"recipients": [
+			{"to": ["a@example.invalid"]},
+			{"to": ["b@example.invalid"]}
+		]
+	}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d != %d", w.Code, http.StatusOK)
+	}
+	messages, err := q.Storage.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("%d != 2", len(messages))
+	}
+	for _, m := range messages {
+		r, err := q.Storage.GetMessageBody(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := mail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, err := mime.ParseMediaType(e.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			mr      = multipart.NewReader(e.Body, params["boundary"])
+			content []byte
+		)
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if p.FileName() == "report.txt" {
+				content, _ = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+			}
+		}
+		if string(content) != "quarterly report" {
+			t.Fatalf("%q != \"quarterly report\"", content)
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(d, "*", "part-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("%d != 2", len(names))
+	}
+	var files []os.FileInfo
+	for _, n := range names {
+		fi, err := os.Stat(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fi)
+	}
+	if !os.SameFile(files[0], files[1]) {
+		t.Fatal("attachment should be stored once")
+	}
+}
@@ -1,5 +1,13 @@
 package api
 
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// Maximum size of an uploaded attachment in bytes when none is configured.
+const defaultMaxUploadSize = 25 * 1024 * 1024
+
 // Configuration for the HTTP API.
 type Config struct {
 	Addr       string `json:"bind"`
@@ -8,4 +16,63 @@ type Config struct {
 	TLSKey     string `json:"tls-key"`
 	Username   string `json:"username"`
 	Password   string `json:"password"`
+
+	// Number of seconds for which the results of requests with an
+	// Idempotency-Key header are kept (zero to ignore the header)
+	IdempotencyWindow int `json:"idempotency-window"`
+
+	// Public URL of the API and the secret used to sign links to it, which
+	// are needed for unsubscribe links in emails
+	PublicURL  string `json:"public-url"`
+	LinkSecret string `json:"link-secret"`
+
+	// Number of seconds for which uploaded attachments are kept after they
+	// were last used (zero to keep them indefinitely)
+	UploadExpiry int `json:"upload-expiry"`
+
+	// Maximum size of an uploaded attachment in bytes
+	MaxUploadSize int64 `json:"max-upload-size"`
+
+	// Number of seconds for which open and click tracking events are kept
+	// (zero to keep them indefinitely)
+	TrackingRetention int `json:"tracking-retention"`
+
+	// URL that is sent a POST request when a recipient unsubscribes
+	UnsubscribeWebhook string `json:"unsubscribe-webhook"`
+}
+
+// Determine whether TLS is enabled.
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// Load the certificate and private key for TLS.
+func (c *Config) loadCertificate() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Determine the maximum size of an uploaded attachment in bytes.
+func (c *Config) maxUploadSize() int64 {
+	if c.MaxUploadSize == 0 {
+		return defaultMaxUploadSize
+	}
+	return c.MaxUploadSize
+}
+
+// Ensure that the configuration is valid. If TLS is enabled, the certificate
+// and private key are loaded to ensure that they can be used.
+func (c *Config) Validate() error {
+	if c.MaxUploadSize < 0 {
+		return errors.New("maximum upload size cannot be negative")
+	}
+	if c.tlsEnabled() {
+		if _, err := c.loadCertificate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
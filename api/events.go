@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Number of events buffered for each subscriber. Events are dropped for
+// subscribers that fall further behind than this.
+const eventBuffer = 100
+
+// Subscribers to the tracking events recorded while they are connected.
+type eventHub struct {
+	m           sync.Mutex
+	subscribers map[chan *trackingEvent]bool
+}
+
+// Add a subscriber, returning the channel that events are sent on.
+func (h *eventHub) subscribe() chan *trackingEvent {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[chan *trackingEvent]bool)
+	}
+	c := make(chan *trackingEvent, eventBuffer)
+	h.subscribers[c] = true
+	return c
+}
+
+// Remove a subscriber.
+func (h *eventHub) unsubscribe(c chan *trackingEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	delete(h.subscribers, c)
+}
+
+// Send an event to all subscribers without waiting for any of them.
+func (h *eventHub) publish(e *trackingEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for c := range h.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// Stream tracking events to the client as server-sent events until it
+// disconnects, optionally only those for the message specified in the query
+// string.
+func (a *API) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != get {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var (
+		messageID = r.URL.Query().Get("message_id")
+		c         = a.eventHub.subscribe()
+	)
+	defer a.eventHub.unsubscribe(c)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	for {
+		select {
+		case e := <-c:
+			if messageID != "" && e.MessageID != messageID {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				a.log.Error(err.Error())
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		case <-a.stopped:
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyRecord = "idempotency"
+)
+
+var errIdempotencyMismatch = errors.New("idempotency key was used with a different request")
+
+// Result of a request made with an idempotency key. The hash of the request
+// body is stored so that reuse of a key for a different request is detected.
+type idempotencyResult struct {
+	Hash    string          `json:"hash"`
+	Created time.Time       `json:"created"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// Locks for idempotency keys with requests in progress. This ensures that
+// concurrent requests with the same key are processed one at a time.
+type keyLocks struct {
+	m     sync.Mutex
+	locks map[string]*keyLock
+}
+
+// Lock for a single key and the number of requests using it.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Acquire the lock for the specified key.
+func (k *keyLocks) lock(key string) {
+	k.m.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.m.Unlock()
+	l.Lock()
+}
+
+// Release the lock for the specified key.
+func (k *keyLocks) unlock(key string) {
+	k.m.Lock()
+	defer k.m.Unlock()
+	l := k.locks[key]
+	l.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// Determine the idempotency window.
+func (a *API) idempotencyWindow() time.Duration {
+	return time.Duration(a.getConfig().IdempotencyWindow) * time.Second
+}
+
+// Create a handler that returns the original result when a request is
+// repeated with the same idempotency key within the configured window. Only
+// successful results are stored, allowing failed requests to be retried.
+func (a *API) idempotent(endpoint string, handler func(r *http.Request) interface{}) func(r *http.Request) interface{} {
+	return func(r *http.Request) interface{} {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || a.idempotencyWindow() <= 0 {
+			return handler(r)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		var (
+			keyHash  = sha256.Sum256([]byte(endpoint + "\x00" + key))
+			bodyHash = sha256.Sum256(body)
+			name     = hex.EncodeToString(keyHash[:])
+			hash     = hex.EncodeToString(bodyHash[:])
+		)
+		a.keyLocks.lock(name)
+		defer a.keyLocks.unlock(name)
+		var result idempotencyResult
+		err = a.queue.Storage.LoadRecord(idempotencyRecord, name, &result)
+		switch {
+		case err == nil && time.Since(result.Created) < a.idempotencyWindow():
+			if result.Hash != hash {
+				return errIdempotencyMismatch
+			}
+			a.log.Debugf("returning stored result for idempotency key %s", key)
+			return result.Result
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		v := handler(r)
+		if _, ok := v.(error); ok {
+			return v
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		result = idempotencyResult{
+			Hash:    hash,
+			Created: time.Now(),
+			Result:  data,
+		}
+		if err := a.queue.Storage.SaveRecord(idempotencyRecord, name, &result); err != nil {
+			a.log.Error(err.Error())
+		}
+		return v
+	}
+}
+
+// Remove idempotency records that are older than the window.
+func (a *API) expireIdempotencyKeys() {
+	names, err := a.queue.Storage.Records(idempotencyRecord)
+	if err != nil {
+		a.log.Error(err.Error())
+		return
+	}
+	for _, name := range names {
+		a.keyLocks.lock(name)
+		var result idempotencyResult
+		err := a.queue.Storage.LoadRecord(idempotencyRecord, name, &result)
+		if err != nil || time.Since(result.Created) >= a.idempotencyWindow() {
+			if err := a.queue.Storage.DeleteRecord(idempotencyRecord, name); err != nil {
+				a.log.Error(err.Error())
+			}
+		}
+		a.keyLocks.unlock(name)
+	}
+}
+
+// Periodically remove expired idempotency records, uploads and tracking
+// events until the API is stopped.
+func (a *API) runExpiry() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		a.expireIdempotencyKeys()
+		a.expireUploads()
+		a.expireTracking()
+		select {
+		case <-ticker.C:
+		case <-a.stopped:
+			return
+		}
+	}
+}
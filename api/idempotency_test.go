@@ -0,0 +1,77 @@
+package api
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestIdempotent(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		a = New(&Config{
+			IdempotencyWindow: 60,
+		}, &queue.Queue{
+			Storage: queue.NewStorage(d),
+		})
+		calls   = 0
+		handler = a.idempotent("test", func(r *http.Request) interface{} {
+			calls++
+			return map[string]int{
+				"calls": calls,
+			}
+		})
+	)
+	request := func(key, body string) interface{} {
+		r, err := http.NewRequest(post, "/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(idempotencyHeader, key)
+		v := handler(r)
+		if raw, ok := v.(json.RawMessage); ok {
+			var m map[string]int
+			if err := json.Unmarshal(raw, &m); err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+		return v
+	}
+	requests := []struct {
+		key, body string
+		calls     int
+	}{
+		{"", "a", 1},
+		{"", "a", 2},
+		{"1", "a", 3},
+		{"1", "a", 3},
+		{"2", "a", 4},
+		{"1", "a", 3},
+	}
+	for _, r := range requests {
+		v, ok := request(r.key, r.body).(map[string]int)
+		if !ok {
+			t.Fatalf("unexpected response %v", v)
+		}
+		if v["calls"] != r.calls {
+			t.Fatalf("%d != %d", v["calls"], r.calls)
+		}
+	}
+	if _, ok := request("1", "b").(error); !ok {
+		t.Fatal("error expected")
+	}
+	a.config.IdempotencyWindow = -1
+	if v := request("1", "a").(map[string]int); v["calls"] != 5 {
+		t.Fatalf("%d != 5", v["calls"])
+	}
+}
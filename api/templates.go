@@ -0,0 +1,101 @@
+package api
+
+import (
+	"github.com/hectane/hectane/email"
+
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// Record kind used for storing templates.
+const templateRecord = "templates"
+
+// Load the template with the specified name.
+func (a *API) loadTemplate(name string) (*email.Template, error) {
+	t := &email.Template{}
+	if err := (&email.Template{Name: name}).Validate(); err != nil {
+		return nil, badRequest(err)
+	}
+	if err := a.queue.Storage.LoadRecord(templateRecord, name, t); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &statusError{
+				error: fmt.Errorf("template \"%s\" does not exist", name),
+				code:  http.StatusNotFound,
+			}
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render the stored template specified by the email, if any.
+func (a *API) renderTemplate(e *email.Email) error {
+	if e.Template == "" {
+		return nil
+	}
+	t, err := a.loadTemplate(e.Template)
+	if err != nil {
+		return err
+	}
+	if err := e.Render(t); err != nil {
+		return badRequest(err)
+	}
+	return nil
+}
+
+// List, retrieve, save, or delete templates. A single template is retrieved
+// or deleted by specifying its name in the query string.
+func (a *API) templates(r *http.Request) interface{} {
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case post:
+		t := &email.Template{}
+		if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+			return err
+		}
+		if err := t.Validate(); err != nil {
+			return badRequest(err)
+		}
+		if err := a.queue.Storage.SaveRecord(templateRecord, t.Name, t); err != nil {
+			return err
+		}
+		return t
+	case del:
+		if _, err := a.loadTemplate(name); err != nil {
+			return err
+		}
+		if err := a.queue.Storage.DeleteRecord(templateRecord, name); err != nil {
+			return err
+		}
+		return struct{}{}
+	}
+	if name != "" {
+		t, err := a.loadTemplate(name)
+		if err != nil {
+			return err
+		}
+		return t
+	}
+	names, err := a.queue.Storage.Records(templateRecord)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	templates := make([]*email.Template, 0, len(names))
+	for _, n := range names {
+		t := &email.Template{}
+		if err := a.queue.Storage.LoadRecord(templateRecord, n, t); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		templates = append(templates, t)
+	}
+	return map[string][]*email.Template{
+		"templates": templates,
+	}
+}
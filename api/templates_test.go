@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	a, q, cleanup := createQueueAPI(t, &Config{})
+	defer cleanup()
+	request := func(method, uri, body string) int {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(method, uri, strings.NewReader(body)))
+		return w.Code
+	}
+	for _, r := range []struct {
+		method, uri, body string
+		code              int
+	}{
+		{post, "/v1/templates", `{"name":"bad","text":"{{.x"}`, http.StatusBadRequest},
+		{post, "/v1/templates", `{"name":"welcome","subject":"Hi {{.name}}"}`, http.StatusOK},
+		{get, "/v1/templates?name=welcome", "", http.StatusOK},
+		{get, "/v1/templates?name=missing", "", http.StatusNotFound},
+		{post, "/v1/send", `{"from":"me@example.invalid","to":["you@example.invalid"],"template":"welcome"}`, http.StatusBadRequest},
+		{post, "/v1/send", `{"from":"me@example.invalid","to":["you@example.invalid"],"template":"missing"}`, http.StatusNotFound},
+		{del, "/v1/templates?name=welcome", "", http.StatusOK},
+		{del, "/v1/templates?name=welcome", "", http.StatusNotFound},
+	} {
+		if code := request(r.method, r.uri, r.body); code != r.code {
+			t.Fatalf("%s %s: %d != %d", r.method, r.uri, code, r.code)
+		}
+	}
+	if messages, _ := q.Storage.Usage(); messages != 0 {
+		t.Fatalf("%d != 0", messages)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"github.com/pborman/uuid"
+
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record kind used for storing tracking events.
+const trackingRecord = "tracking"
+
+// Transparent 1x1 GIF served for tracking pixels.
+var trackingPixel, _ = base64.StdEncoding.DecodeString("R0lGODlhAQABAIAAAAAAAP///yH5BAEAAAAALAAAAAABAAEAAAIBRAA7")
+
+// Open or click by the recipient of a message.
+type trackingEvent struct {
+	MessageID string    `json:"message_id"`
+	Recipient string    `json:"recipient"`
+	Type      string    `json:"type"`
+	URL       string    `json:"url,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Determine the prefix of the names of the tracking records for a message.
+// The message ID is encoded so that the records for a message can be found
+// without loading the others.
+func trackingPrefix(messageID string) string {
+	return hex.EncodeToString([]byte(messageID)) + "."
+}
+
+// Verify a tracking link and record the event. False is returned if the link
+// is invalid, in which case an error has been written to the response.
+func (a *API) recordTracking(w http.ResponseWriter, r *http.Request, eventType string) (*trackingEvent, bool) {
+	v, err := a.verifyLink(r)
+	if err != nil {
+		http.Error(w, err.Error(), err.(*statusError).code)
+		return nil, false
+	}
+	e := &trackingEvent{
+		MessageID: v.Get("message_id"),
+		Recipient: v.Get("recipient"),
+		Type:      eventType,
+		URL:       v.Get("url"),
+		Time:      time.Now(),
+	}
+	if e.MessageID == "" || e.Recipient == "" {
+		http.Error(w, errInvalidLink.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if err := a.queue.Storage.SaveRecord(trackingRecord, trackingPrefix(e.MessageID)+uuid.New(), e); err != nil {
+		a.log.Error(err.Error())
+	}
+	a.eventHub.publish(e)
+	return e, true
+}
+
+// Record an open and serve the tracking pixel.
+func (a *API) trackOpen(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.recordTracking(w, r, "open"); !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(trackingPixel)))
+	w.Header().Set("Content-Type", "image/gif")
+	w.Write(trackingPixel)
+}
+
+// Record a click and redirect to the original URL. The URL is part of the
+// signed parameters, so the endpoint cannot be used to redirect elsewhere.
+func (a *API) trackClick(w http.ResponseWriter, r *http.Request) {
+	e, ok := a.recordTracking(w, r, "click")
+	if !ok {
+		return
+	}
+	if e.URL == "" {
+		http.Error(w, errInvalidLink.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, e.URL, http.StatusFound)
+}
+
+// Retrieve the tracking events in the order they occurred, optionally only
+// those for the message specified in the query string.
+func (a *API) tracking(r *http.Request) interface{} {
+	names, err := a.queue.Storage.Records(trackingRecord)
+	if err != nil {
+		return err
+	}
+	var (
+		messageID = r.URL.Query().Get("message_id")
+		events    = make([]*trackingEvent, 0, len(names))
+	)
+	for _, n := range names {
+		if messageID != "" && !strings.HasPrefix(n, trackingPrefix(messageID)) {
+			continue
+		}
+		e := &trackingEvent{}
+		if err := a.queue.Storage.LoadRecord(trackingRecord, n, e); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return map[string][]*trackingEvent{
+		"events": events,
+	}
+}
+
+// Remove tracking events that are older than the retention period.
+func (a *API) expireTracking() {
+	retention := time.Duration(a.getConfig().TrackingRetention) * time.Second
+	if retention <= 0 {
+		return
+	}
+	names, err := a.queue.Storage.Records(trackingRecord)
+	if err != nil {
+		a.log.Error(err.Error())
+		return
+	}
+	for _, name := range names {
+		e := &trackingEvent{}
+		err := a.queue.Storage.LoadRecord(trackingRecord, name, e)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil || time.Since(e.Time) >= retention {
+			if err := a.queue.Storage.DeleteRecord(trackingRecord, name); err != nil {
+				a.log.Error(err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"github.com/hectane/hectane/email"
+
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracking(t *testing.T) {
+	a, _, cleanup := createQueueAPI(t, &Config{
+		PublicURL:  "https://example.com",
+		LinkSecret: "secret",
+	})
+	defer cleanup()
+	fetch := func(link string) *httptest.ResponseRecorder {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(get, u.RequestURI(), nil))
+		return w
+	}
+	v := url.Values{
+		"message_id": []string{"1234"},
+		"recipient":  []string{"you@example.com"},
+	}
+	if w := fetch(a.links().URL(email.OpenPath, v)); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+	v.Set("url", "https://example.org/")
+	click := a.links().URL(email.ClickPath, v)
+	if w := fetch(click); w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.org/" {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+	if w := fetch(click + "&url=https://example.net/"); w.Code != http.StatusForbidden {
+		t.Fatalf("%d != %d", w.Code, http.StatusForbidden)
+	}
+	w := fetch("/v1/tracking?message_id=1234")
+	var events map[string][]*trackingEvent
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if l := events["events"]; len(l) != 2 || l[0].Type != "open" || l[1].Type != "click" {
+		t.Fatalf("unexpected events %v", l)
+	}
+	w = fetch("/v1/tracking?message_id=5678")
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if l := events["events"]; len(l) != 0 {
+		t.Fatalf("%d != 0", len(l))
+	}
+}
+
+func TestTrackingRetention(t *testing.T) {
+	a, q, cleanup := createQueueAPI(t, &Config{
+		TrackingRetention: 3600,
+	})
+	defer cleanup()
+	for name, age := range map[string]time.Duration{
+		trackingPrefix("1234") + "old": 2 * time.Hour,
+		trackingPrefix("1234") + "new": time.Minute,
+	} {
+		e := &trackingEvent{
+			MessageID: "1234",
+			Recipient: "you@example.com",
+			Type:      "open",
+			Time:      time.Now().Add(-age),
+		}
+		if err := q.Storage.SaveRecord(trackingRecord, name, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.expireTracking()
+	names, err := q.Storage.Records(trackingRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != trackingPrefix("1234")+"new" {
+		t.Fatalf("unexpected records %v", names)
+	}
+}
+
+func TestTrackingEvents(t *testing.T) {
+	a, _, cleanup := createQueueAPI(t, &Config{
+		PublicURL:  "https://example.com",
+		LinkSecret: "secret",
+	})
+	defer cleanup()
+	s := httptest.NewServer(a)
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/v1/events?message_id=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("%s != text/event-stream", ct)
+	}
+	for _, id := range []string{"5678", "1234"} {
+		v := url.Values{
+			"message_id": []string{id},
+			"recipient":  []string{"you@example.com"},
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(get, a.links().URL(email.OpenPath, v), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d != %d", w.Code, http.StatusOK)
+		}
+	}
+	var (
+		br    = bufio.NewReader(resp.Body)
+		lines []string
+	)
+	for len(lines) < 2 {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(l))
+	}
+	if lines[0] != "event: open" {
+		t.Fatalf("%s != event: open", lines[0])
+	}
+	e := &trackingEvent{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), e); err != nil {
+		t.Fatal(err)
+	}
+	if e.MessageID != "1234" || e.Recipient != "you@example.com" {
+		t.Fatalf("unexpected event %v", e)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"github.com/hectane/hectane/email"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Number of seconds to wait for the unsubscribe webhook to respond.
+const webhookTimeout = 10
+
+var errInvalidLink = errors.New("link is invalid")
+
+// Create the generator for signed links, which is nil if links are not
+// configured.
+func (a *API) links() *email.Links {
+	config := a.getConfig()
+	if config.PublicURL == "" || config.LinkSecret == "" {
+		return nil
+	}
+	return &email.Links{
+		BaseURL: config.PublicURL,
+		Secret:  []byte(config.LinkSecret),
+	}
+}
+
+// Verify the signed link used for the request, returning an error with the
+// appropriate status code if it is invalid.
+func (a *API) verifyLink(r *http.Request) (url.Values, error) {
+	l := a.links()
+	if l == nil {
+		return nil, &statusError{
+			error: errors.New("signed links are not configured"),
+			code:  http.StatusNotFound,
+		}
+	}
+	v, ok := l.Verify(r.URL.Path, r.URL.Query())
+	if !ok {
+		return nil, &statusError{
+			error: errInvalidLink,
+			code:  http.StatusForbidden,
+		}
+	}
+	return v, nil
+}
+
+// Notify the unsubscribe webhook, if one is configured.
+func (a *API) notifyUnsubscribe(address string) {
+	webhook := a.getConfig().UnsubscribeWebhook
+	if webhook == "" {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"address": address,
+		"time":    time.Now(),
+	})
+	if err != nil {
+		a.log.Error(err.Error())
+		return
+	}
+	c := &http.Client{Timeout: webhookTimeout * time.Second}
+	resp, err := c.Post(webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		a.log.Errorf("unsubscribe webhook failed: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		a.log.Errorf("unsubscribe webhook returned %s", resp.Status)
+	}
+}
+
+// Unsubscribe a recipient using a one-click unsubscribe link (RFC 8058). The
+// address is added to the suppression list.
+func (a *API) unsubscribe(r *http.Request) interface{} {
+	v, err := a.verifyLink(r)
+	if err != nil {
+		return err
+	}
+	address := v["address"]
+	if len(address) != 1 {
+		return &statusError{
+			error: errInvalidLink,
+			code:  http.StatusBadRequest,
+		}
+	}
+	if _, err := a.queue.Storage.Suppress(address[0], "unsubscribed"); err != nil {
+		return err
+	}
+	a.log.Infof("%s unsubscribed", address[0])
+	go a.notifyUnsubscribe(address[0])
+	return struct{}{}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"github.com/hectane/hectane/email"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnsubscribe(t *testing.T) {
+	var (
+		notified = make(chan bool, 1)
+		webhook  = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			notified <- true
+		}))
+	)
+	defer webhook.Close()
+	a, q, cleanup := createQueueAPI(t, &Config{
+		Username:           "test",
+		Password:           "test",
+		PublicURL:          "https://example.com",
+		LinkSecret:         "secret",
+		UnsubscribeWebhook: webhook.URL,
+	})
+	defer cleanup()
+	unsubscribe := func(link string) int {
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(post, u.RequestURI(), strings.NewReader("List-Unsubscribe=One-Click"))
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w.Code
+	}
+	link := a.links().URL(email.UnsubscribePath, url.Values{
+		"address": []string{"me@example.com"},
+	})
+	if code := unsubscribe(link + "x"); code != http.StatusForbidden {
+		t.Fatalf("%d != %d", code, http.StatusForbidden)
+	}
+	if code := unsubscribe(link); code != http.StatusOK {
+		t.Fatalf("%d != %d", code, http.StatusOK)
+	}
+	if ok, _ := q.Storage.IsSuppressed("me@example.com"); !ok {
+		t.Fatal("address should be suppressed")
+	}
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+}
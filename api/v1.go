@@ -2,42 +2,184 @@ package api
 
 import (
 	"github.com/hectane/hectane/email"
+	"github.com/hectane/hectane/queue"
 	"github.com/hectane/hectane/version"
 
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"strconv"
 )
 
+// Number of seconds clients are asked to wait when messages are refused.
+const retryAfter = 60
+
+var errDraining = errors.New("server is draining")
+
+// Create an error indicating that the service is temporarily unavailable.
+func unavailable(err error) error {
+	return &statusError{
+		error: err,
+		code:  http.StatusServiceUnavailable,
+		headers: map[string]string{
+			"Retry-After": strconv.Itoa(retryAfter),
+		},
+	}
+}
+
+// Create an error indicating that the request is invalid.
+func badRequest(err error) error {
+	return &statusError{
+		error: err,
+		code:  http.StatusBadRequest,
+	}
+}
+
+// Ensure that new messages can be accepted. Messages are refused while
+// draining and when the queue is full.
+func (a *API) checkAccepting() error {
+	if a.isDraining() {
+		return unavailable(errDraining)
+	}
+	err := a.queue.CheckCapacity()
+	if _, ok := err.(*queue.CapacityError); ok {
+		a.log.Warning(err.Error())
+		return unavailable(err)
+	}
+	return err
+}
+
+// Create a response containing the IDs of the specified messages and the
+// recipients that were omitted because they are in the suppression list.
+func messageIDs(messages []*queue.Message, suppressed []string) interface{} {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID()
+	}
+	if suppressed == nil {
+		suppressed = []string{}
+	}
+	return map[string][]string{
+		"message_ids": ids,
+		"suppressed":  suppressed,
+	}
+}
+
 // Send a raw MIME message.
 func (a *API) raw(r *http.Request) interface{} {
+	if err := a.checkAccepting(); err != nil {
+		return err
+	}
 	var raw email.Raw
 	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
 		return err
 	}
-	if err := raw.DeliverToQueue(a.queue); err != nil {
+	messages, suppressed, err := raw.DeliverToQueue(a.queue)
+	if err != nil {
 		return err
 	}
-	return struct{}{}
+	return messageIDs(messages, suppressed)
 }
 
 // Send an email with the specified parameters.
 func (a *API) send(r *http.Request) interface{} {
+	if err := a.checkAccepting(); err != nil {
+		return err
+	}
 	var e email.Email
 	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
 		return err
 	}
-	messages, err := e.Messages(a.queue.Storage)
+	e.Links = a.links()
+	if err := a.renderTemplate(&e); err != nil {
+		return err
+	}
+	messages, suppressed, err := e.Messages(a.queue.Storage)
 	if err != nil {
-		return map[string]string{
-			"error": err.Error(),
-		}
+		return err
 	}
 	for _, m := range messages {
 		a.queue.Deliver(m)
 	}
+	return messageIDs(messages, suppressed)
+}
+
+// List, add, or remove entries in the suppression list. Entries are removed
+// by specifying the address in the query string.
+func (a *API) suppressions(r *http.Request) interface{} {
+	switch r.Method {
+	case post:
+		var params struct {
+			Address string `json:"address"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			return err
+		}
+		if params.Address == "" {
+			return badRequest(errors.New("address is required"))
+		}
+		suppression, err := a.queue.Storage.Suppress(params.Address, params.Reason)
+		if err != nil {
+			return err
+		}
+		return suppression
+	case del:
+		if err := a.queue.Storage.Unsuppress(r.URL.Query().Get("address")); err != nil {
+			if os.IsNotExist(err) {
+				return &statusError{
+					error: errors.New("address is not suppressed"),
+					code:  http.StatusNotFound,
+				}
+			}
+			return err
+		}
+		return struct{}{}
+	default:
+		suppressions, err := a.queue.Storage.Suppressions()
+		if err != nil {
+			return err
+		}
+		return map[string][]*queue.Suppression{
+			"suppressions": suppressions,
+		}
+	}
+}
+
+// Begin draining the server.
+func (a *API) startDrain(r *http.Request) interface{} {
+	a.Drain()
+	return struct{}{}
+}
+
+// Reload the configuration of the application.
+func (a *API) reloadConfig(r *http.Request) interface{} {
+	a.m.Lock()
+	reload := a.reload
+	a.m.Unlock()
+	if reload == nil {
+		return errors.New("reloading is not available")
+	}
+	if err := reload(); err != nil {
+		return err
+	}
 	return struct{}{}
 }
 
+// Report whether the server is ready to accept new messages.
+func (a *API) ready(r *http.Request) interface{} {
+	if a.isDraining() {
+		return &statusError{
+			error: errDraining,
+			code:  http.StatusServiceUnavailable,
+		}
+	}
+	return map[string]bool{
+		"ready": true,
+	}
+}
+
 // Retrieve status information.
 func (a *API) status(r *http.Request) interface{} {
 	return a.queue.Status()
@@ -6,10 +6,14 @@ import (
 	"github.com/hectane/hectane/queue"
 	"github.com/hectane/hectane/smtp"
 
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 )
 
 // Global configuration for the application.
@@ -18,6 +22,13 @@ type Config struct {
 	Log   log.Config   `json:"log"`
 	Queue queue.Config `json:"queue"`
 	SMTP  smtp.Config  `json:"smtp"`
+
+	// Number of seconds to wait for in-flight transactions when draining
+	DrainTimeout int `json:"drain-timeout"`
+
+	// Values from the command line and the file they were combined with
+	base     *Config
+	filename string
 }
 
 // Parse the flags passed to the application
@@ -32,26 +43,84 @@ func Parse() (*Config, error) {
 	flag.StringVar(&c.API.TLSKey, "tls-key", "", "private key `file` for TLS")
 	flag.StringVar(&c.API.Username, "username", "", "`username` for HTTP basic auth")
 	flag.StringVar(&c.API.Password, "password", "", "`password` for HTTP basic auth")
+	flag.IntVar(&c.API.IdempotencyWindow, "idempotency-window", 86400, "`seconds` to remember idempotency keys")
+	flag.StringVar(&c.API.PublicURL, "public-url", "", "public `URL` of the API used in links")
+	flag.StringVar(&c.API.LinkSecret, "link-secret", "", "`secret` for signing links to the API")
+	flag.StringVar(&c.API.UnsubscribeWebhook, "unsubscribe-webhook", "", "`URL` to notify when a recipient unsubscribes")
+	flag.IntVar(&c.API.UploadExpiry, "upload-expiry", 86400, "`seconds` to keep unused uploaded attachments")
+	flag.Int64Var(&c.API.MaxUploadSize, "max-upload-size", 25*1024*1024, "maximum `bytes` in an uploaded attachment")
+	flag.IntVar(&c.API.TrackingRetention, "tracking-retention", 2592000, "`seconds` to keep open and click tracking events")
+	flag.IntVar(&c.DrainTimeout, "drain-timeout", 30, "`seconds` to wait for transactions when shutting down")
 	flag.BoolVar(&c.Log.Debug, "debug", false, "show debug log messages")
 	flag.StringVar(&c.Log.Logfile, "logfile", "", "`file` to write log output to")
 	flag.StringVar(&c.Queue.Directory, "directory", path.Join(os.TempDir(), "hectane"), "`directory` for persistent storage")
+	flag.StringVar(&c.Queue.Compression, "compression", "", "compression `format` for queued bodies (gzip or zstd)")
+	flag.IntVar(&c.Queue.MaxMessages, "max-messages", 0, "maximum `number` of queued messages")
+	flag.Int64Var(&c.Queue.MaxBytes, "max-bytes", 0, "maximum `bytes` used by queued messages")
+	flag.Int64Var(&c.Queue.MinFreeBytes, "min-free-bytes", 0, "`bytes` of disk space to keep free")
+	flag.StringVar(&c.Queue.BounceDomain, "bounce-domain", "", "`domain` for VERP return paths")
+	flag.StringVar(&c.Queue.BounceSecret, "bounce-secret", "", "`secret` for signing VERP return paths")
 	flag.BoolVar(&c.Queue.DisableSSLVerification, "disable-ssl-verification", false, "don't verify SSL certificates")
 	flag.StringVar(&c.SMTP.Addr, "smtp-addr", ":smtp", "`address` and port for SMTP server")
 	flag.IntVar(&c.SMTP.ReadTimeout, "read-timeout", 900, "`seconds` before client timeout")
+	flag.Int64Var(&c.SMTP.MaxMessageSize, "max-message-size", 25*1024*1024, "maximum `bytes` in a message received via SMTP")
 	flag.Parse()
-	if *filename != "" {
-		r, err := os.Open(*filename)
-		if err != nil {
-			return nil, err
-		}
-		defer r.Close()
-		if err = json.NewDecoder(r).Decode(c); err != nil {
-			return nil, err
-		}
+	base := *c
+	c.base = &base
+	c.filename = *filename
+	if err := c.load(c); err != nil {
+		return nil, err
 	}
 	return c, nil
 }
 
+// Decode the configuration file (if any) into the specified value.
+func (c *Config) load(v *Config) error {
+	if c.filename == "" {
+		return nil
+	}
+	r, err := os.Open(c.filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// Reload the configuration file, returning the new configuration. Values
+// from the command line are used for anything not specified in the file.
+func (c *Config) Reload() (*Config, error) {
+	if c.filename == "" {
+		return nil, errors.New("no configuration file was specified")
+	}
+	n := *c.base
+	n.base = c.base
+	n.filename = c.filename
+	if err := c.load(&n); err != nil {
+		return nil, err
+	}
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// Validate ensures that each section of the configuration is valid.
+func (c *Config) Validate() error {
+	if err := c.API.Validate(); err != nil {
+		return err
+	}
+	if err := c.Queue.Validate(); err != nil {
+		return err
+	}
+	return c.SMTP.Validate()
+}
+
+// Retrieve the name of the configuration file, if one was specified.
+func (c *Config) Filename() string {
+	return c.filename
+}
+
 // Save the configuration to the specified path.
 func (c *Config) Save(path string) error {
 	w, err := os.Create(path)
@@ -64,3 +133,78 @@ func (c *Config) Save(path string) error {
 	}
 	return nil
 }
+
+// Add a DKIM signature for the domain to the specified configuration file.
+// Only the contents of the file are rewritten so that values from the command
+// line (which may include secrets) are not stored in it. The file is replaced
+// atomically.
+func AddDKIMConfig(filename, domain string, d queue.DKIMConfig) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var (
+		file    = map[string]json.RawMessage{}
+		q       = map[string]json.RawMessage{}
+		configs = map[string]queue.DKIMConfigList{}
+	)
+	if len(bytes.TrimSpace(b)) != 0 {
+		if err := json.Unmarshal(b, &file); err != nil {
+			return err
+		}
+	}
+	if v, ok := file["queue"]; ok {
+		if err := json.Unmarshal(v, &q); err != nil {
+			return err
+		}
+	}
+	if v, ok := q["dkim-configs"]; ok {
+		if err := json.Unmarshal(v, &configs); err != nil {
+			return err
+		}
+	}
+	configs[domain] = append(configs[domain], d)
+	if q["dkim-configs"], err = json.Marshal(configs); err != nil {
+		return err
+	}
+	if file["queue"], err = json.Marshal(q); err != nil {
+		return err
+	}
+	if b, err = json.MarshalIndent(file, "", "    "); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(b, '\n'))
+}
+
+// Replace the contents of a file by writing them to a temporary file in the
+// same directory and renaming it, retaining the permissions of the original.
+func writeFileAtomic(filename string, data []byte) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(info.Mode())
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package cfg
 
 import (
+	"github.com/hectane/hectane/queue"
+
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -21,3 +24,81 @@ func TestSave(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestReload(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		f = filepath.Join(d, "config.json")
+		c = &Config{
+			base:     &Config{DrainTimeout: 30},
+			filename: f,
+		}
+	)
+	if err := ioutil.WriteFile(f, []byte(`{"smtp": {"read_timeout": 10}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.SMTP.ReadTimeout != 10 {
+		t.Fatalf("%d != 10", n.SMTP.ReadTimeout)
+	}
+	if n.DrainTimeout != 30 {
+		t.Fatalf("%d != 30", n.DrainTimeout)
+	}
+	if err := ioutil.WriteFile(f, []byte(`{"smtp": {"read_timeout": -1}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Reload(); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestAddDKIMConfig(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	f := filepath.Join(d, "config.json")
+	if err := ioutil.WriteFile(f, []byte(`{
+		"smtp": {"read_timeout": 10},
+		"queue": {"dkim-configs": {"example.org": {"selector": "a"}}}
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"example.org", "example.com"} {
+		if err := AddDKIMConfig(f, domain, queue.DKIMConfig{Selector: "b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.SMTP.ReadTimeout != 10 {
+		t.Fatalf("%d != 10", c.SMTP.ReadTimeout)
+	}
+	if l := len(c.Queue.DKIMConfigs["example.org"]); l != 2 {
+		t.Fatalf("%d != 2", l)
+	}
+	if l := len(c.Queue.DKIMConfigs["example.com"]); l != 1 {
+		t.Fatalf("%d != 1", l)
+	}
+	var file map[string]interface{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := file["api"]; ok {
+		t.Fatal("unexpected api section")
+	}
+}
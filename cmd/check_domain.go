@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"github.com/hectane/hectane/cfg"
+	"github.com/hectane/hectane/queue"
+
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var errCheckFailed = errors.New("one or more checks failed")
+
+// Outcome of a single check. Checks that could not be performed are skipped
+// rather than failed.
+type checkResult struct {
+	name    string
+	ok      bool
+	skipped bool
+	detail  string
+}
+
+// Describe the result in a human-readable way.
+func (c *checkResult) String() string {
+	status := "PASS"
+	switch {
+	case c.skipped:
+		status = "SKIP"
+	case !c.ok:
+		status = "FAIL"
+	}
+	return fmt.Sprintf("%s  %-6s %s", status, c.name, c.detail)
+}
+
+// Checker for the DNS records needed to send mail from a domain.
+type domainChecker struct {
+	resolver resolver
+	config   *queue.Config
+	ips      []net.IP
+}
+
+// Check that the domain has mail exchangers.
+func (d *domainChecker) checkMX(domain string) *checkResult {
+	r := &checkResult{name: "MX"}
+	mxs, err := d.resolver.LookupMX(domain)
+	if err != nil && !isNotFound(err) {
+		r.detail = err.Error()
+		return r
+	}
+	var hosts []string
+	for _, mx := range mxs {
+		if mx.Host == "." {
+			r.detail = "domain does not accept mail (null MX)"
+			return r
+		}
+		hosts = append(hosts, fmt.Sprintf("%s (%d)", strings.TrimSuffix(mx.Host, "."), mx.Pref))
+	}
+	if len(hosts) == 0 {
+		r.detail = "no MX records found"
+		return r
+	}
+	r.ok = true
+	r.detail = strings.Join(hosts, ", ")
+	return r
+}
+
+// Check that the domain has an SPF record and that it permits each of the
+// outbound IP addresses. If there are none, the check of the record is
+// reported as skipped since its existence alone says nothing about whether
+// mail will pass.
+func (d *domainChecker) checkSPF(domain string) []*checkResult {
+	records, err := lookupPrefixedTXT(d.resolver, domain, "v=spf1")
+	switch {
+	case err != nil:
+		return []*checkResult{{name: "SPF", detail: err.Error()}}
+	case len(records) == 0:
+		return []*checkResult{{name: "SPF", detail: "no SPF record found"}}
+	case len(records) > 1:
+		return []*checkResult{{name: "SPF", detail: "multiple SPF records found"}}
+	}
+	results := []*checkResult{{name: "SPF", ok: true, detail: records[0]}}
+	if len(d.ips) == 0 {
+		return append(results, &checkResult{
+			name:    "SPF",
+			ok:      true,
+			skipped: true,
+			detail:  "no outbound IP addresses configured to check",
+		})
+	}
+	for _, ip := range d.ips {
+		result := checkSPF(d.resolver, domain, ip)
+		results = append(results, &checkResult{
+			name:   "SPF",
+			ok:     result == spfPass,
+			detail: fmt.Sprintf("%s: %s", ip, result),
+		})
+	}
+	return results
+}
+
+// Check that the public key for each configured DKIM selector is published
+// and matches the private key.
+func (d *domainChecker) checkDKIM(domain string) []*checkResult {
+	var (
+		configs = d.config.DKIMConfigs[domain]
+		results []*checkResult
+	)
+	if len(configs) == 0 {
+		return []*checkResult{{name: "DKIM", detail: "no selectors configured"}}
+	}
+	for _, c := range configs {
+		signingDomain := domain
+		if c.Domain != "" {
+			signingDomain = c.Domain
+		}
+		r := &checkResult{
+			name: "DKIM",
+		}
+		results = append(results, r)
+		name := fmt.Sprintf("%s._domainkey.%s", c.Selector, signingDomain)
+		private, err := c.PublicKey()
+		if err != nil {
+			r.detail = fmt.Sprintf("%s: %s", name, err)
+			continue
+		}
+		published, err := queue.LookupDKIMKey(d.resolver.LookupTXT, c.Selector, signingDomain)
+		if err != nil {
+			r.detail = fmt.Sprintf("%s: %s", name, err)
+			continue
+		}
+		if k, ok := private.(interface {
+			Equal(crypto.PublicKey) bool
+		}); !ok || !k.Equal(published) {
+			r.detail = fmt.Sprintf("%s: published key does not match private key", name)
+			continue
+		}
+		r.ok = true
+		r.detail = fmt.Sprintf("%s: published key matches", name)
+	}
+	return results
+}
+
+// Check that the domain has a DMARC policy.
+func (d *domainChecker) checkDMARC(domain string) *checkResult {
+	r := &checkResult{name: "DMARC"}
+	records, err := lookupPrefixedTXT(d.resolver, "_dmarc."+domain, "v=DMARC1")
+	switch {
+	case err != nil:
+		r.detail = err.Error()
+	case len(records) == 0:
+		r.detail = "no DMARC record found"
+	case len(records) > 1:
+		r.detail = "multiple DMARC records found"
+	default:
+		r.ok = true
+		r.detail = records[0]
+	}
+	return r
+}
+
+// Run each of the checks for the domain.
+func (d *domainChecker) check(domain string) []*checkResult {
+	results := []*checkResult{d.checkMX(domain)}
+	results = append(results, d.checkSPF(domain)...)
+	results = append(results, d.checkDKIM(domain)...)
+	return append(results, d.checkDMARC(domain))
+}
+
+// Parse a list of IP addresses.
+func parseIPs(values []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address \"%s\"", v)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Run the checks for a domain using the specified resolver, printing a
+// report. The outbound IP addresses are taken from the configuration unless
+// specified with a flag. Flags may appear before or after the domain. An
+// error is returned if any of the checks failed.
+func checkDomain(r resolver, config *cfg.Config, args []string) error {
+	var (
+		flags   = flag.NewFlagSet("check-domain", flag.ContinueOnError)
+		ips     = flags.String("ips", "", "comma-separated outbound IP `addresses` to check against SPF")
+		domains []string
+	)
+	for {
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		domains = append(domains, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(domains) != 1 {
+		return errors.New("a single domain must be specified")
+	}
+	values := config.Queue.OutboundIPs
+	if *ips != "" {
+		values = strings.Split(*ips, ",")
+	}
+	addrs, err := parseIPs(values)
+	if err != nil {
+		return err
+	}
+	d := &domainChecker{
+		resolver: r,
+		config:   &config.Queue,
+		ips:      addrs,
+	}
+	failed := false
+	for _, result := range d.check(domains[0]) {
+		fmt.Println(result)
+		if !result.ok {
+			failed = true
+		}
+	}
+	if failed {
+		return errCheckFailed
+	}
+	return nil
+}
+
+// Check that the DNS records for a domain are ready for sending mail.
+var checkDomainCommand = &command{
+	name:        "check-domain",
+	description: "check the MX, SPF, DKIM and DMARC records of a domain [-ips] domain",
+	exec: func(config *cfg.Config, args []string) error {
+		return checkDomain(netResolver{}, config, args)
+	},
+}
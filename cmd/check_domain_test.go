@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"github.com/hectane/hectane/cfg"
+	"github.com/hectane/hectane/queue"
+
+	"net"
+	"testing"
+)
+
+// Resolver that answers queries from fixed records.
+type fakeResolver struct {
+	txt map[string][]string
+	mx  map[string][]*net.MX
+	ip  map[string][]net.IP
+}
+
+var errNotFound = &net.DNSError{Err: "no such host", IsNotFound: true}
+
+func (f *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if v, ok := f.txt[name]; ok {
+		return v, nil
+	}
+	return nil, errNotFound
+}
+
+func (f *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	if v, ok := f.mx[name]; ok {
+		return v, nil
+	}
+	return nil, errNotFound
+}
+
+func (f *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	if v, ok := f.ip[host]; ok {
+		return v, nil
+	}
+	return nil, errNotFound
+}
+
+func TestSPF(t *testing.T) {
+	r := &fakeResolver{
+		txt: map[string][]string{
+			"example.org":      {"v=spf1 ip4:192.0.2.0/24 a mx/24 include:_spf.example.org -all"},
+			"_spf.example.org": {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"example.net":      {"v=spf1 redirect=example.org"},
+			"example.com":      {"v=spf1 include:example.invalid -all"},
+		},
+		mx: map[string][]*net.MX{
+			"example.org": {{Host: "mx.example.org.", Pref: 10}},
+		},
+		ip: map[string][]net.IP{
+			"example.org":     {net.ParseIP("203.0.113.1")},
+			"mx.example.org.": {net.ParseIP("198.51.100.1")},
+		},
+	}
+	for _, test := range []struct {
+		domain, ip, result string
+	}{
+		{"example.org", "192.0.2.10", spfPass},
+		{"example.org", "203.0.113.1", spfPass},
+		{"example.org", "198.51.100.200", spfPass},
+		{"example.org", "2001:db8::1", spfPass},
+		{"example.org", "203.0.113.2", spfFail},
+		{"example.net", "192.0.2.10", spfPass},
+		{"example.net", "203.0.113.2", spfFail},
+		{"example.com", "192.0.2.10", spfPermError},
+		{"example.invalid", "192.0.2.10", spfNone},
+	} {
+		if result := checkSPF(r, test.domain, net.ParseIP(test.ip)); result != test.result {
+			t.Fatalf("%s %s: %s != %s", test.domain, test.ip, result, test.result)
+		}
+	}
+}
+
+func TestCheckDomain(t *testing.T) {
+	key, record, err := queue.GenerateDKIMKey("ed25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		r = &fakeResolver{
+			txt: map[string][]string{
+				"example.org":                  {"v=spf1 ip4:192.0.2.0/24 -all"},
+				"s1._domainkey.example.org":    {record},
+				"_dmarc.example.org":           {"v=DMARC1; p=reject"},
+				"s1._domainkey.example.net":    {record},
+				"stale._domainkey.example.net": {"v=DKIM1; k=ed25519; p=MCowBQYDK2VwAyEA"},
+			},
+			mx: map[string][]*net.MX{
+				"example.org": {{Host: "mx.example.org.", Pref: 10}},
+			},
+		}
+		config = &cfg.Config{
+			Queue: queue.Config{
+				DKIMConfigs: map[string]queue.DKIMConfigList{
+					"example.org": {{PrivateKey: key, Selector: "s1"}},
+					"example.net": {{PrivateKey: key, Selector: "stale"}},
+				},
+			},
+		}
+	)
+	if err := checkDomain(r, config, []string{"-ips", "192.0.2.1", "example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDomain(r, config, []string{"-ips", "203.0.113.1", "example.org"}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := checkDomain(r, config, []string{"example.org", "-ips", "203.0.113.1"}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := checkDomain(r, config, []string{"example.net"}); err == nil {
+		t.Fatal("error expected")
+	}
+	config.Queue.OutboundIPs = []string{"203.0.113.1"}
+	if err := checkDomain(r, config, []string{"example.org"}); err == nil {
+		t.Fatal("error expected")
+	}
+	d := &domainChecker{
+		resolver: r,
+		config:   &config.Queue,
+	}
+	if results := d.checkSPF("example.org"); len(results) != 2 || !results[1].skipped {
+		t.Fatal("SPF check should be skipped without outbound IP addresses")
+	}
+	if results := d.checkDKIM("example.net"); len(results) != 1 || results[0].ok {
+		t.Fatal("DKIM check should fail for a mismatched key")
+	}
+}
@@ -11,12 +11,19 @@ import (
 type command struct {
 	name        string
 	description string
-	exec        func(*cfg.Config) error
+	exec        func(config *cfg.Config, args []string) error
 }
 
 // List of valid commands.
 var commands []*command
 
+// Commands available on every platform.
+var commonCommands = []*command{
+	fsckCommand,
+	dkimKeygenCommand,
+	checkDomainCommand,
+}
+
 // Display a list of valid commands.
 func Print() {
 	if len(commands) != 0 {
@@ -28,11 +35,12 @@ func Print() {
 	}
 }
 
-// Execute the specified command if available.
-func Exec(name string, config *cfg.Config) error {
+// Execute the specified command if available. Any remaining arguments are
+// passed to the command.
+func Exec(name string, args []string, config *cfg.Config) error {
 	for _, c := range commands {
 		if name == c.name {
-			return c.exec(config)
+			return c.exec(config, args)
 		}
 	}
 	return fmt.Errorf("invalid command \"%s\"", name)
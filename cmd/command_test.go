@@ -1,11 +1,41 @@
 package cmd
 
 import (
+	"github.com/hectane/hectane/cfg"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestBadCommand(t *testing.T) {
-	if err := Exec("", nil); err == nil {
+	if err := Exec("", nil, nil); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestDKIMKeygen(t *testing.T) {
+	Init()
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		f    = filepath.Join(d, "dkim.pem")
+		args = []string{"-domain", "example.org", "-selector", "s1", "-algo", "ed25519", "-out", f}
+	)
+	if err := Exec("dkim-keygen", args, &cfg.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := Exec("dkim-keygen", args, &cfg.Config{}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := Exec("dkim-keygen", append(args, "-save"), &cfg.Config{}); err == nil {
 		t.Fatal("error expected")
 	}
 }
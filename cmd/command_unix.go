@@ -4,5 +4,5 @@ package cmd
 
 // Initialize the commands available for the current platform.
 func Init() {
-	commands = []*command{}
+	commands = commonCommands
 }
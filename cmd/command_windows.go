@@ -61,7 +61,7 @@ func serviceCommand(name string) error {
 var installCommand = &command{
 	name:        "install",
 	description: "install the service (Windows only)",
-	exec: func(config *cfg.Config) error {
+	exec: func(config *cfg.Config, args []string) error {
 		m, err := mgr.Connect()
 		if err != nil {
 			return err
@@ -112,7 +112,7 @@ var installCommand = &command{
 var startCommand = &command{
 	name:        "start",
 	description: "start the service (Windows only)",
-	exec: func(config *cfg.Config) error {
+	exec: func(config *cfg.Config, args []string) error {
 		return serviceCommand("start")
 	},
 }
@@ -121,7 +121,7 @@ var startCommand = &command{
 var stopCommand = &command{
 	name:        "stop",
 	description: "stop the service (Windows only)",
-	exec: func(config *cfg.Config) error {
+	exec: func(config *cfg.Config, args []string) error {
 		return serviceCommand("stop")
 	},
 }
@@ -130,7 +130,7 @@ var stopCommand = &command{
 var removeCommand = &command{
 	name:        "remove",
 	description: "remove the service (Windows only)",
-	exec: func(config *cfg.Config) error {
+	exec: func(config *cfg.Config, args []string) error {
 		if err := serviceCommand("remove"); err != nil {
 			return err
 		}
@@ -140,10 +140,10 @@ var removeCommand = &command{
 
 // Initialize the commands available for the current platform.
 func Init() {
-	commands = []*command{
+	commands = append([]*command{
 		installCommand,
 		removeCommand,
 		startCommand,
 		stopCommand,
-	}
+	}, commonCommands...)
 }
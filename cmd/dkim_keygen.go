@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"github.com/hectane/hectane/cfg"
+	"github.com/hectane/hectane/queue"
+
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Generate a DKIM private key and display the DNS record that must be
+// published for it. The key can also be added to the configuration file.
+var dkimKeygenCommand = &command{
+	name:        "dkim-keygen",
+	description: "generate a DKIM key -domain -selector [-algo rsa|ed25519] [-bits] [-out] [-save]",
+	exec: func(config *cfg.Config, args []string) error {
+		var (
+			flags    = flag.NewFlagSet("dkim-keygen", flag.ContinueOnError)
+			domain   = flags.String("domain", "", "`domain` the key signs mail for")
+			selector = flags.String("selector", "", "`selector` for the key")
+			algo     = flags.String("algo", "rsa", "key `algorithm` (rsa or ed25519)")
+			bits     = flags.Int("bits", 2048, "`size` of RSA keys")
+			out      = flags.String("out", "", "`file` to write the private key to")
+			save     = flags.Bool("save", false, "add the key to the configuration file")
+		)
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *domain == "" || *selector == "" {
+			return errors.New("-domain and -selector are required")
+		}
+		if *save && config.Filename() == "" {
+			return errors.New("-save requires a configuration file")
+		}
+		if *out == "" {
+			*out = fmt.Sprintf("%s.%s.pem", *selector, *domain)
+		}
+		key, record, err := queue.GenerateDKIMKey(*algo, *bits)
+		if err != nil {
+			return err
+		}
+		// Refuse to overwrite an existing key since it may still be in use
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(key); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("private key written to %s\n", *out)
+		fmt.Printf("publish the following DNS record:\n\n%s\n\n", queue.DKIMRecord(*selector, *domain, record))
+		if *save {
+			name, err := filepath.Abs(*out)
+			if err != nil {
+				return err
+			}
+			if err := cfg.AddDKIMConfig(config.Filename(), *domain, queue.DKIMConfig{
+				PrivateKeyFile: name,
+				Selector:       *selector,
+				Algorithm:      *algo + "-sha256",
+			}); err != nil {
+				return err
+			}
+			fmt.Printf("key added to %s\n", config.Filename())
+		}
+		return nil
+	},
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"github.com/hectane/hectane/cfg"
+	"github.com/hectane/hectane/queue"
+
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Check the queue directory for damaged or orphaned files. By default, the
+// problems are only reported. The queue must not be in use while repairs are
+// being made.
+var fsckCommand = &command{
+	name:        "fsck",
+	description: "check the queue directory for problems [-repair|-quarantine] [-dry-run]",
+	exec: func(config *cfg.Config, args []string) error {
+		var (
+			flags      = flag.NewFlagSet("fsck", flag.ContinueOnError)
+			repair     = flags.Bool("repair", false, "delete damaged files")
+			quarantine = flags.Bool("quarantine", false, "move damaged files to the quarantine directory")
+			dryRun     = flags.Bool("dry-run", false, "show what would be done without doing it")
+		)
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *repair && *quarantine {
+			return errors.New("-repair and -quarantine are mutually exclusive")
+		}
+		s, err := queue.NewStorageFromConfig(&config.Queue)
+		if err != nil {
+			return err
+		}
+		problems, err := s.Check()
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			switch {
+			case *repair:
+				fmt.Printf("%s (removing)\n", p)
+				if !*dryRun {
+					err = s.Repair(p)
+				}
+			case *quarantine:
+				fmt.Printf("%s (quarantining)\n", p)
+				if !*dryRun {
+					err = s.Quarantine(p)
+				}
+			default:
+				fmt.Println(p)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return nil
+	},
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of mechanisms and modifiers that cause DNS lookups during
+// SPF evaluation (RFC 7208, section 4.6.4).
+const spfLookupLimit = 10
+
+// Results of SPF evaluation.
+const (
+	spfNone      = "none"
+	spfNeutral   = "neutral"
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+var errSPFLookupLimit = errors.New("too many DNS lookups")
+
+// Resolver for the DNS records needed to check a domain.
+type resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupIP(host string) ([]net.IP, error)
+}
+
+// Resolver using the system's DNS configuration.
+type netResolver struct{}
+
+// Look up the TXT records for the name.
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+// Look up the MX records for the name.
+func (netResolver) LookupMX(name string) ([]*net.MX, error) {
+	return net.LookupMX(name)
+}
+
+// Look up the IP addresses of the host.
+func (netResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+// Determine whether a DNS error indicates that no records exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
+
+// Retrieve the TXT records for a name that begin with the specified version
+// tag, such as "v=spf1". A name with no records is not an error.
+func lookupPrefixedTXT(r resolver, name, prefix string) ([]string, error) {
+	txts, err := r.LookupTXT(name)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	var records []string
+	for _, t := range txts {
+		if len(t) < len(prefix) || !strings.EqualFold(t[:len(prefix)], prefix) {
+			continue
+		}
+		if rest := t[len(prefix):]; rest == "" || rest[0] == ' ' || rest[0] == ';' {
+			records = append(records, t)
+		}
+	}
+	return records, nil
+}
+
+// Evaluator for SPF records (RFC 7208). Macros and the ptr mechanism are not
+// supported; terms using them never match.
+type spfEvaluator struct {
+	resolver resolver
+	ip       net.IP
+	lookups  int
+}
+
+// Count a DNS lookup, failing once the limit has been exceeded.
+func (s *spfEvaluator) lookup() error {
+	s.lookups++
+	if s.lookups > spfLookupLimit {
+		return errSPFLookupLimit
+	}
+	return nil
+}
+
+// Parse an optional CIDR suffix, returning the name and prefix lengths for
+// IPv4 and IPv6 addresses.
+func parseCIDR(value string) (string, int, int, error) {
+	var (
+		v4 = 32
+		v6 = 128
+	)
+	parts := strings.SplitN(value, "//", 2)
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, errors.New("invalid CIDR length")
+		}
+		v6 = n
+	}
+	value = parts[0]
+	if i := strings.LastIndex(value, "/"); i != -1 {
+		n, err := strconv.Atoi(value[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, errors.New("invalid CIDR length")
+		}
+		v4, value = n, value[:i]
+	}
+	return value, v4, v6, nil
+}
+
+// Determine whether the IP address is in the same network as the address
+// using the prefix length for its family.
+func (s *spfEvaluator) matchIP(ip net.IP, v4, v6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		if s.ip.To4() == nil {
+			return false
+		}
+		return ip4.Mask(net.CIDRMask(v4, 32)).Equal(s.ip.To4().Mask(net.CIDRMask(v4, 32)))
+	}
+	if s.ip.To4() != nil {
+		return false
+	}
+	return ip.Mask(net.CIDRMask(v6, 128)).Equal(s.ip.Mask(net.CIDRMask(v6, 128)))
+}
+
+// Determine whether any address of the host matches.
+func (s *spfEvaluator) matchHost(host string, v4, v6 int) (bool, error) {
+	ips, err := s.resolver.LookupIP(host)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	for _, ip := range ips {
+		if s.matchIP(ip, v4, v6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Evaluate a single mechanism for the domain, returning whether it matched or
+// the result that ends evaluation immediately.
+func (s *spfEvaluator) match(domain, mechanism, value string) (bool, string) {
+	if strings.Contains(value, "%") {
+		return false, ""
+	}
+	switch mechanism {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		if !strings.Contains(value, "/") {
+			if mechanism == "ip4" {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return false, spfPermError
+		}
+		return n.Contains(s.ip), ""
+	case "a", "mx":
+		if err := s.lookup(); err != nil {
+			return false, spfPermError
+		}
+		name, v4, v6, err := parseCIDR(value)
+		if err != nil {
+			return false, spfPermError
+		}
+		if name == "" {
+			name = domain
+		}
+		hosts := []string{name}
+		if mechanism == "mx" {
+			mxs, err := s.resolver.LookupMX(name)
+			if err != nil && !isNotFound(err) {
+				return false, spfTempError
+			}
+			hosts = nil
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, h := range hosts {
+			ok, err := s.matchHost(h, v4, v6)
+			if err != nil {
+				return false, spfTempError
+			}
+			if ok {
+				return true, ""
+			}
+		}
+		return false, ""
+	case "exists":
+		if err := s.lookup(); err != nil {
+			return false, spfPermError
+		}
+		ips, err := s.resolver.LookupIP(value)
+		if err != nil && !isNotFound(err) {
+			return false, spfTempError
+		}
+		return len(ips) != 0, ""
+	case "include":
+		if err := s.lookup(); err != nil {
+			return false, spfPermError
+		}
+		switch result := s.evaluate(value); result {
+		case spfPass:
+			return true, ""
+		case spfNone:
+			return false, spfPermError
+		case spfTempError, spfPermError:
+			return false, result
+		default:
+			return false, ""
+		}
+	case "ptr":
+		return false, ""
+	default:
+		return false, spfPermError
+	}
+}
+
+// Evaluate the SPF record for the domain.
+func (s *spfEvaluator) evaluate(domain string) string {
+	records, err := lookupPrefixedTXT(s.resolver, domain, "v=spf1")
+	if err != nil {
+		return spfTempError
+	}
+	switch len(records) {
+	case 0:
+		return spfNone
+	case 1:
+	default:
+		return spfPermError
+	}
+	var redirect string
+	for _, term := range strings.Fields(records[0])[1:] {
+		term = strings.ToLower(term)
+		if strings.HasPrefix(term, "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		}
+		if strings.Contains(term, "=") && !strings.ContainsAny(strings.SplitN(term, "=", 2)[0], ":/") {
+			continue
+		}
+		result := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = spfFail, term[1:]
+		case '~':
+			result, term = spfSoftFail, term[1:]
+		case '?':
+			result, term = spfNeutral, term[1:]
+		}
+		var (
+			mechanism = term
+			value     string
+		)
+		if i := strings.IndexAny(term, ":/"); i != -1 {
+			mechanism = term[:i]
+			value = strings.TrimPrefix(term[i:], ":")
+		}
+		ok, final := s.match(domain, mechanism, value)
+		if final != "" {
+			return final
+		}
+		if ok {
+			return result
+		}
+	}
+	if redirect != "" {
+		if err := s.lookup(); err != nil {
+			return spfPermError
+		}
+		if result := s.evaluate(redirect); result != spfNone {
+			return result
+		}
+		return spfPermError
+	}
+	return spfNeutral
+}
+
+// Evaluate the SPF record for mail from the domain sent by the IP address.
+func checkSPF(r resolver, domain string, ip net.IP) string {
+	s := &spfEvaluator{
+		resolver: r,
+		ip:       ip,
+	}
+	return s.evaluate(domain)
+}
@@ -1,12 +1,28 @@
 package email
 
 import (
+	"github.com/hectane/hectane/queue"
+
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net/http"
 	"net/textproto"
+	"path"
+	"strings"
+	"unicode"
 )
 
+// Maximum length of lines of base64-encoded content (RFC 2045, section 6.8).
+const base64LineLength = 76
+
 // Email attachment. The content of the attachment is provided either as a
 // UTF-8 string or as a Base64-encoded string ("encoded" set to "true").
 type Attachment struct {
@@ -14,35 +30,250 @@ type Attachment struct {
 	ContentType string `json:"content_type"`
 	Content     string `json:"content"`
 	Encoded     bool   `json:"encoded"`
+	ContentID   string `json:"content_id"`
+	Inline      bool   `json:"inline"`
+	Upload      string `json:"upload"`
+
+	// Function for opening the content of an upload
+	open func() (io.ReadCloser, error)
+
+	// Encoded content shared by the bodies of a batch
+	part *queue.Part
 }
 
-// Write the attachment to the specified multipart writer.
-func (a Attachment) Write(w *multipart.Writer) error {
-	headers := make(textproto.MIMEHeader)
+var errUploadContent = errors.New("attachment cannot have both content and an upload")
+
+// Retrieve the content ID without angle brackets, as it is referenced in
+// "cid:" URLs (RFC 2392).
+func (a Attachment) contentID() string {
+	return strings.TrimSuffix(strings.TrimPrefix(a.ContentID, "<"), ">")
+}
+
+// Decode the content of the attachment. Line breaks and other whitespace in
+// Base64-encoded content are ignored.
+func (a Attachment) decode() ([]byte, error) {
+	if !a.Encoded {
+		return []byte(a.Content), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, a.Content))
+	if err != nil {
+		return nil, fmt.Errorf("attachment \"%s\" is not valid Base64: %s", a.Filename, err)
+	}
+	return b, nil
+}
+
+// Ensure that Base64-encoded content can be decoded.
+func (a Attachment) Validate() error {
+	if a.Upload != "" && a.Content != "" {
+		return errUploadContent
+	}
+	_, err := a.decode()
+	return err
+}
+
+// Open the decoded content of the attachment for reading. The content of
+// uploads is streamed from storage.
+func (a Attachment) reader() (io.ReadCloser, error) {
+	if a.open != nil {
+		return a.open()
+	}
+	content, err := a.decode()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Determine the content type of the attachment. If none was provided, it is
+// determined from the filename extension or, failing that, the content.
+func (a Attachment) contentType(content []byte) string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if t := mime.TypeByExtension(path.Ext(a.Filename)); t != "" {
+		return t
+	}
+	return http.DetectContentType(content)
+}
+
+// Determine whether the string contains only printable ASCII characters.
+func isPrintableASCII(s string) bool {
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Add a quoted filename parameter to a header value.
+// Filenames that are not ASCII are also encoded as described in RFC 2231,
+// with the quoted parameter containing an ASCII approximation for clients
+// that do not support it.
+func formatFilename(value, param, filename string) string {
+	quoted := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, filename)
+	quoted = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(quoted)
+	value = fmt.Sprintf("%s; %s=\"%s\"", value, param, quoted)
+	if !isPrintableASCII(filename) {
+		value += fmt.Sprintf("; %s*=utf-8''%s", param, encodeExtValue(filename))
+	}
+	return value
+}
+
+// Percent-encode the characters of a parameter value that are not permitted
+// in an RFC 2231 extended value.
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c > ' ' && c < 0x7f && !strings.ContainsRune("*'%()<>@,;:\\\"/[]?=", rune(c)) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Writer that breaks Base64-encoded content into lines of the maximum
+// length.
+type lineWriter struct {
+	w io.Writer
+	n int
+}
+
+// Write the content, beginning a new line whenever necessary.
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.n == base64LineLength {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			l.n = 0
+		}
+		k := base64LineLength - l.n
+		if k > len(p) {
+			k = len(p)
+		}
+		if _, err := l.w.Write(p[:k]); err != nil {
+			return written, err
+		}
+		l.n += k
+		written += k
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// Create the part for the attachment in the specified multipart writer.
+// Attachments with a filename or that are inline include a
+// Content-Disposition header (RFC 2183).
+func (a Attachment) createPart(w *multipart.Writer, contentType string, encoded bool) (io.Writer, error) {
+	var (
+		headers     = make(textproto.MIMEHeader)
+		disposition = "attachment"
+	)
+	if a.Inline {
+		disposition = "inline"
+	}
 	if len(a.Filename) != 0 {
-		headers.Add("Content-Type", fmt.Sprintf("%s; name=%s", a.ContentType, a.Filename))
+		headers.Add("Content-Type", formatFilename(contentType, "name", a.Filename))
+		headers.Add("Content-Disposition", formatFilename(disposition, "filename", a.Filename))
 	} else {
-		headers.Add("Content-Type", a.ContentType)
+		headers.Add("Content-Type", contentType)
+		if a.Inline {
+			headers.Add("Content-Disposition", disposition)
+		}
+	}
+	if a.ContentID != "" {
+		headers.Add("Content-ID", fmt.Sprintf("<%s>", a.contentID()))
 	}
-	if a.Encoded {
+	if encoded {
 		headers.Add("Content-Transfer-Encoding", "base64")
 	} else {
 		headers.Add("Content-Transfer-Encoding", "quoted-printable")
 	}
-	p, err := w.CreatePart(headers)
+	return w.CreatePart(headers)
+}
+
+// Write the attachment to the specified multipart writer. The content of
+// uploads is always encoded as Base64.
+func (a Attachment) Write(w *multipart.Writer) error {
+	c, err := a.reader()
 	if err != nil {
 		return err
 	}
-	if a.Encoded {
-		if _, err := p.Write([]byte(a.Content)); err != nil {
-			return err
-		}
+	defer c.Close()
+	var (
+		r       = bufio.NewReader(c)
+		head, _ = r.Peek(512)
+		encoded = a.Encoded || a.open != nil
+	)
+	p, err := a.createPart(w, a.contentType(head), encoded)
+	if err != nil {
+		return err
+	}
+	var e io.WriteCloser
+	if encoded {
+		e = base64.NewEncoder(base64.StdEncoding, &lineWriter{w: p})
 	} else {
-		q := quotedprintable.NewWriter(p)
-		if _, err := q.Write([]byte(a.Content)); err != nil {
-			return err
-		}
-		return q.Close()
+		e = quotedprintable.NewWriter(p)
+	}
+	if _, err := io.Copy(e, r); err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+// Store the content of the attachment encoded as Base64 in a part that can be
+// shared by several bodies. The content type is determined at the same time
+// since the content is not read again when the part is written.
+func (a *Attachment) share(s *queue.Storage) error {
+	c, err := a.reader()
+	if err != nil {
+		return err
 	}
+	defer c.Close()
+	var (
+		r       = bufio.NewReader(c)
+		head, _ = r.Peek(512)
+	)
+	w, p, err := s.NewPart()
+	if err != nil {
+		return err
+	}
+	e := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: w})
+	if _, err := io.Copy(e, r); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := e.Close(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	a.ContentType = a.contentType(head)
+	a.part = p
 	return nil
 }
+
+// Write an attachment whose content was shared to the specified multipart
+// writer, adding the part to the body instead of copying its content.
+func (a Attachment) writeShared(w *multipart.Writer, b *queue.BodyWriter) error {
+	if _, err := a.createPart(w, a.ContentType, true); err != nil {
+		return err
+	}
+	return b.WritePart(a.part)
+}
@@ -2,10 +2,17 @@ package email
 
 import (
 	"github.com/hectane/go-attest"
+	"github.com/hectane/hectane/queue"
 
 	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -51,3 +58,141 @@ func TestAttachmentWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAttachmentHeaders(t *testing.T) {
+	var (
+		filename = "résumé \"final\".pdf"
+		content  = strings.Repeat("x", 100)
+		a        = &Attachment{
+			Filename: filename,
+			Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+			Encoded:  true,
+		}
+		buff = &bytes.Buffer{}
+		w    = multipart.NewWriter(buff)
+		r    = multipart.NewReader(buff, w.Boundary())
+	)
+	if err := a.Write(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := r.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := part.Header.Get("Content-Type"); !strings.HasPrefix(c, "application/pdf;") {
+		t.Fatalf("unexpected content type %s", c)
+	}
+	disposition, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disposition != "attachment" || params["filename"] != filename {
+		t.Fatalf("unexpected disposition %s %v", disposition, params)
+	}
+	b, err := ioutil.ReadAll(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b), "\r\n")
+	if len(lines) != 2 || len(lines[0]) != 76 {
+		t.Fatalf("unexpected line lengths in %q", b)
+	}
+	if err := (Attachment{Content: "bm90 IGJh\r\nc2U2NA==", Encoded: true}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Attachment{Content: "not base64!", Encoded: true}).Validate(); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestAttachmentSniff(t *testing.T) {
+	for _, a := range []Attachment{
+		{Filename: "image.png"},
+		{Content: "\x89PNG\r\n\x1a\n"},
+	} {
+		if c := a.contentType([]byte(a.Content)); c != "image/png" {
+			t.Fatalf("%s != image/png", c)
+		}
+	}
+}
+
+func TestAttachmentUpload(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := queue.NewStorage(d)
+	u := &queue.Upload{
+		Filename:    "report.csv",
+		ContentType: "text/csv",
+	}
+	if err := s.SaveUpload(u, strings.NewReader("a,b\n1,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	e := &Email{
+		From: "me@example.com",
+		To:   []string{"you@example.com"},
+		Attachments: []Attachment{
+			{Upload: u.ID},
+		},
+	}
+	m, _, err := e.Messages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GetMessageBody(m[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		"Content-Type: text/csv; name=\"report.csv\"",
+		base64.StdEncoding.EncodeToString([]byte("a,b\n1,2\n")),
+	} {
+		if !bytes.Contains(body, []byte(v)) {
+			t.Fatalf("%q missing from body", v)
+		}
+	}
+	e.Attachments = []Attachment{{Upload: "missing"}}
+	if _, _, err := e.Messages(s); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestAttachmentUploadError(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := queue.NewStorage(d)
+	e := &Email{
+		From: "me@example.com",
+		To:   []string{"you@example.com"},
+		Attachments: []Attachment{
+			{
+				open: func() (io.ReadCloser, error) {
+					return nil, errors.New("upload unavailable")
+				},
+			},
+		},
+	}
+	if _, _, err := e.Messages(s); err == nil {
+		t.Fatal("error expected")
+	}
+	problems, err := s.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("%d != 0", len(problems))
+	}
+}
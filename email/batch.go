@@ -0,0 +1,105 @@
+package email
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"errors"
+)
+
+var (
+	errBatchAddresses = errors.New("addresses must be specified for each recipient of a batch")
+	errBatchRecipient = errors.New("recipient has no addresses")
+)
+
+// Recipient of a batch with its own data for rendering the template.
+type BatchRecipient struct {
+	To   []string               `json:"to"`
+	Cc   []string               `json:"cc"`
+	Bcc  []string               `json:"bcc"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// Email sent separately to each of a list of recipients. The subject, text
+// and HTML of the email are used as an inline template unless a stored
+// template is specified.
+type Batch struct {
+	Email
+	Recipients []*BatchRecipient `json:"recipients"`
+}
+
+// Retrieve the inline template for the batch.
+func (b *Batch) InlineTemplate() *Template {
+	return &Template{
+		Name:    "inline",
+		Subject: b.Subject,
+		Text:    b.Text,
+		Html:    b.Html,
+	}
+}
+
+// Ensure that the addresses are specified for each recipient rather than for
+// the batch as a whole.
+func (b *Batch) Validate() error {
+	if len(b.To) != 0 || len(b.Cc) != 0 || len(b.Bcc) != 0 {
+		return errBatchAddresses
+	}
+	return nil
+}
+
+// Store the content of the attachments once so that it is shared by the
+// bodies for every recipient instead of being copied into each of them.
+// Inline images are not shared since they are written with the HTML. The
+// returned function deletes the stored content once the messages for the
+// batch have been created; the bodies keep their own references to it.
+func (b *Batch) ShareAttachments(s *queue.Storage) (func(), error) {
+	if err := b.resolveUploads(s); err != nil {
+		return nil, err
+	}
+	var parts []*queue.Part
+	release := func() {
+		for _, p := range parts {
+			p.Delete()
+		}
+	}
+	for i := range b.Attachments {
+		a := &b.Attachments[i]
+		if err := a.Validate(); err != nil {
+			release()
+			return nil, err
+		}
+		if a.ContentID != "" {
+			continue
+		}
+		if err := a.share(s); err != nil {
+			release()
+			return nil, err
+		}
+		parts = append(parts, a.part)
+	}
+	return release, nil
+}
+
+// Create the email for a single recipient of the batch by rendering the
+// template with the recipient's data, which takes precedence over the data
+// for the batch. The attachments are shared with the batch.
+func (b *Batch) RecipientEmail(t *Template, r *BatchRecipient) (*Email, error) {
+	if len(r.To) == 0 && len(r.Cc) == 0 && len(r.Bcc) == 0 {
+		return nil, errBatchRecipient
+	}
+	data := make(map[string]interface{})
+	for k, v := range b.Data {
+		data[k] = v
+	}
+	for k, v := range r.Data {
+		data[k] = v
+	}
+	e := b.Email
+	e.To, e.Cc, e.Bcc, e.Data = r.To, r.Cc, r.Bcc, data
+	if err := e.Render(t); err != nil {
+		return nil, err
+	}
+	if _, err := GroupAddressesByHost(append(append(e.To, e.Cc...), e.Bcc...)); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,322 @@
+package email
+
+import (
+	"github.com/pborman/uuid"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Methods for calendar invitations (RFC 5546).
+const (
+	MethodRequest = "REQUEST"
+	MethodCancel  = "CANCEL"
+)
+
+// Maximum length of lines in iCalendar data, excluding the line break (RFC
+// 5545, section 3.1).
+const icalLineLength = 75
+
+var (
+	errEventMethod    = errors.New("event method must be REQUEST or CANCEL")
+	errEventOrganizer = errors.New("event organizer is required")
+	errEventUID       = errors.New("event UID is required to cancel an event")
+	errEventTimes     = errors.New("event must end after it starts")
+)
+
+// Calendar event sent as an invitation. The start and end are either RFC
+// 3339 timestamps or local times ("2006-01-02T15:04:05") in the time zone,
+// which is an IANA name such as "Europe/Berlin". Times are sent in the time
+// zone if one is specified and in UTC otherwise.
+type Event struct {
+	UID         string   `json:"uid"`
+	Method      string   `json:"method"`
+	Sequence    int      `json:"sequence"`
+	Organizer   string   `json:"organizer"`
+	Attendees   []string `json:"attendees"`
+	Summary     string   `json:"summary"`
+	Description string   `json:"description"`
+	Location    string   `json:"location"`
+	Start       string   `json:"start"`
+	End         string   `json:"end"`
+	TimeZone    string   `json:"time_zone"`
+}
+
+// Load the time zone of the event, which is UTC if none was specified.
+func (e *Event) location() (*time.Location, error) {
+	if e.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(e.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event time zone: %s", err)
+	}
+	return loc, nil
+}
+
+// Parse a time for the event in the specified time zone.
+func parseEventTime(name, value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid event %s \"%s\"", name, value)
+	}
+	return t, nil
+}
+
+// Remove control characters other than line breaks and tabs, which are not
+// permitted in iCalendar values.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < ' ' && r != '\t' && r != '\r' && r != '\n') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Escape a text value (RFC 5545, section 3.3.11). Line breaks of any kind
+// are escaped and other control characters are removed.
+func icalText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\r", `\n`,
+		"\n", `\n`,
+	).Replace(stripControl(s))
+}
+
+// Quote a parameter value, which cannot contain double quotes or control
+// characters (RFC 5545, section 3.1).
+func icalParam(s string) string {
+	return fmt.Sprintf("\"%s\"", strings.Map(func(r rune) rune {
+		switch {
+		case r == '"':
+			return '\''
+		case r < ' ' || r == 0x7f:
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// Format a time as a UTC date-time value.
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Format a date-time property for the event. Times in a time zone other than
+// UTC are local times referring to the time zone definition.
+func icalDateTime(name string, t time.Time, loc *time.Location) string {
+	if loc == time.UTC {
+		return name + ":" + icalTime(t)
+	}
+	return fmt.Sprintf("%s;TZID=%s:%s", name, loc, t.In(loc).Format("20060102T150405"))
+}
+
+// Format a UTC offset in seconds (RFC 5545, section 3.3.14).
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		s += fmt.Sprintf("%02d", offset%60)
+	}
+	return s
+}
+
+// Find the time at which the offset of the location changes between the
+// specified times, which must have different offsets.
+func findTransition(loc *time.Location, before, after time.Time) time.Time {
+	_, offset := before.In(loc).Zone()
+	for after.Sub(before) > time.Second {
+		mid := before.Add(after.Sub(before) / 2)
+		if _, o := mid.In(loc).Zone(); o == offset {
+			before = mid
+		} else {
+			after = mid
+		}
+	}
+	return after
+}
+
+// Generate the observance of a time zone beginning at the specified time,
+// with the offset it replaces.
+func icalObservance(t time.Time, loc *time.Location, from int) []string {
+	var (
+		local        = t.In(loc)
+		name, offset = local.Zone()
+		kind         = "STANDARD"
+	)
+	if local.IsDST() {
+		kind = "DAYLIGHT"
+	}
+	return []string{
+		"BEGIN:" + kind,
+		"DTSTART:" + t.Add(time.Duration(from)*time.Second).UTC().Format("20060102T150405"),
+		"TZOFFSETFROM:" + icalOffset(from),
+		"TZOFFSETTO:" + icalOffset(offset),
+		"TZNAME:" + icalText(name),
+		"END:" + kind,
+	}
+}
+
+// Generate the definition of a time zone (RFC 5545, section 3.6.5) with the
+// transitions from the year before the event starts until the end of the
+// year in which it ends, which is enough for clients to interpret its times.
+func icalTimeZone(loc *time.Location, start, end time.Time) []string {
+	var (
+		t         = time.Date(start.Year()-1, 1, 1, 0, 0, 0, 0, time.UTC)
+		last      = time.Date(end.Year()+1, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, offset = t.In(loc).Zone()
+		lines     = []string{"BEGIN:VTIMEZONE", "TZID:" + loc.String()}
+	)
+	lines = append(lines, icalObservance(t, loc, offset)...)
+	for t.Before(last) {
+		next := t.Add(24 * time.Hour)
+		if _, o := next.In(loc).Zone(); o != offset {
+			lines = append(lines, icalObservance(findTransition(loc, t, next), loc, offset)...)
+			offset = o
+		}
+		t = next
+	}
+	return append(lines, "END:VTIMEZONE")
+}
+
+// Format a calendar user address with its common name parameter, returning
+// the parameters and the value.
+func icalAddress(address string) (string, string, error) {
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", "", err
+	}
+	params := ""
+	if a.Name != "" {
+		params = ";CN=" + icalParam(a.Name)
+	}
+	return params, "mailto:" + a.Address, nil
+}
+
+// Write a content line, folding it so that no line exceeds the maximum
+// length. Continuation lines begin with a space and are only folded between
+// UTF-8 characters.
+func writeICalLine(b *bytes.Buffer, line string) {
+	limit := icalLineLength
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		b.WriteString(line[:i] + "\r\n ")
+		line = line[i:]
+		limit = icalLineLength - 1
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// Retrieve the method of the event, which defaults to REQUEST.
+func (e *Event) method() string {
+	if e.Method == "" {
+		return MethodRequest
+	}
+	return strings.ToUpper(e.Method)
+}
+
+// Generate the iCalendar object (RFC 5545) for the event. The summary is
+// used if the event does not have one. If the event has no UID, one is
+// generated and stored in the event.
+func (e *Event) iCalendar(summary string) (string, error) {
+	method := e.method()
+	if method != MethodRequest && method != MethodCancel {
+		return "", errEventMethod
+	}
+	if e.Organizer == "" {
+		return "", errEventOrganizer
+	}
+	if e.UID == "" {
+		if method == MethodCancel {
+			return "", errEventUID
+		}
+		e.UID = uuid.New() + "@hectane"
+	}
+	loc, err := e.location()
+	if err != nil {
+		return "", err
+	}
+	start, err := parseEventTime("start", e.Start, loc)
+	if err != nil {
+		return "", err
+	}
+	end, err := parseEventTime("end", e.End, loc)
+	if err != nil {
+		return "", err
+	}
+	if !end.After(start) {
+		return "", errEventTimes
+	}
+	if e.Summary != "" {
+		summary = e.Summary
+	}
+	status := "CONFIRMED"
+	if method == MethodCancel {
+		status = "CANCELLED"
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"PRODID:-//Hectane//Hectane//EN",
+		"VERSION:2.0",
+		"CALSCALE:GREGORIAN",
+		"METHOD:" + method,
+	}
+	if loc != time.UTC {
+		lines = append(lines, icalTimeZone(loc, start, end)...)
+	}
+	lines = append(lines,
+		"BEGIN:VEVENT",
+		"UID:"+icalText(e.UID),
+		"DTSTAMP:"+icalTime(time.Now()),
+		icalDateTime("DTSTART", start, loc),
+		icalDateTime("DTEND", end, loc),
+		fmt.Sprintf("SEQUENCE:%d", e.Sequence),
+		"STATUS:"+status,
+		"SUMMARY:"+icalText(summary),
+	)
+	if e.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+icalText(e.Description))
+	}
+	if e.Location != "" {
+		lines = append(lines, "LOCATION:"+icalText(e.Location))
+	}
+	params, value, err := icalAddress(e.Organizer)
+	if err != nil {
+		return "", fmt.Errorf("invalid event organizer: %s", err)
+	}
+	lines = append(lines, "ORGANIZER"+params+":"+value)
+	for _, a := range e.Attendees {
+		params, value, err := icalAddress(a)
+		if err != nil {
+			return "", fmt.Errorf("invalid event attendee: %s", err)
+		}
+		lines = append(lines, fmt.Sprintf(
+			"ATTENDEE%s;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:%s",
+			params, value,
+		))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+	b := &bytes.Buffer{}
+	for _, l := range lines {
+		writeICalLine(b, l)
+	}
+	return b.String(), nil
+}
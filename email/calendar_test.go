@@ -0,0 +1,116 @@
+package email
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestEventICalendar(t *testing.T) {
+	e := &Event{
+		Organizer:   "Organizer <organizer@example.com>",
+		Attendees:   []string{"=?utf-8?q?Attendee=07=0A?= <attendee@example.com>"},
+		Description: strings.Repeat("Agenda; notes, ", 10) + "\rline\x00",
+		Start:       "2030-01-02T10:00:00",
+		End:         "2030-01-02T11:30:00",
+		TimeZone:    "America/New_York",
+	}
+	ics, err := e.iCalendar("Meeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.UID == "" {
+		t.Fatal("UID should be generated")
+	}
+	unfolded := strings.Replace(ics, "\r\n ", "", -1)
+	for _, l := range []string{
+		"METHOD:REQUEST",
+		"TZID:America/New_York",
+		"BEGIN:DAYLIGHT",
+		"DTSTART:20300310T020000",
+		"TZOFFSETFROM:-0500",
+		"TZOFFSETTO:-0400",
+		"TZNAME:EDT",
+		"DTSTART;TZID=America/New_York:20300102T100000",
+		"DTEND;TZID=America/New_York:20300102T113000",
+		"SUMMARY:Meeting",
+		"ORGANIZER;CN=\"Organizer\":mailto:organizer@example.com",
+		"ATTENDEE;CN=\"Attendee\";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:attendee@example.com",
+	} {
+		if !strings.Contains(unfolded, l+"\r\n") {
+			t.Fatalf("%q missing from %s", l, ics)
+		}
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(l) > icalLineLength {
+			t.Fatalf("line too long: %q", l)
+		}
+	}
+	if !strings.Contains(unfolded, `Agenda\; notes\, \nline`+"\r\n") {
+		t.Fatal("description not escaped")
+	}
+	e.TimeZone = ""
+	if ics, err = e.iCalendar("Meeting"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ics, "DTSTART:20300102T100000Z\r\n") || strings.Contains(ics, "VTIMEZONE") {
+		t.Fatalf("unexpected times in %s", ics)
+	}
+	for _, e := range []*Event{
+		{Organizer: "o@example.com", Method: "PUBLISH", Start: e.Start, End: e.End},
+		{Organizer: "o@example.com", Method: "cancel", Start: e.Start, End: e.End},
+		{Organizer: "o@example.com", Start: e.End, End: e.Start},
+		{Start: e.Start, End: e.End},
+	} {
+		if _, err := e.iCalendar(""); err == nil {
+			t.Fatalf("error expected for %+v", e)
+		}
+	}
+}
+
+func TestEmailEvent(t *testing.T) {
+	_, body, err := emailToMessages(&Email{
+		From:    "organizer@example.com",
+		To:      []string{"attendee@example.com"},
+		Subject: "Meeting",
+		Text:    "Invitation",
+		Event: &Event{
+			Method:    "cancel",
+			UID:       "1234@example.com",
+			Organizer: "organizer@example.com",
+			Start:     "2030-01-02T10:00:00Z",
+			End:       "2030-01-02T11:00:00Z",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	description := &multipartDesc{
+		ContentType: "multipart/mixed",
+		Parts: []*multipartDesc{
+			{
+				ContentType: "multipart/alternative",
+				Parts: []*multipartDesc{
+					{ContentType: "text/plain", Content: []byte("Invitation")},
+					{ContentType: "text/html", Content: []byte("Invitation")},
+				},
+			},
+		},
+	}
+	if err := checkMultipart(m.Body, m.Header.Get("Content-Type"), description); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		"Content-Type: text/calendar; charset=utf-8; method=CANCEL",
+		"Content-Type: application/ics; name=\"invite.ics\"",
+	} {
+		if !bytes.Contains(body, []byte(v)) {
+			t.Fatalf("%q missing from body", v)
+		}
+	}
+}
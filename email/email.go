@@ -5,12 +5,16 @@ import (
 	"github.com/kennygrant/sanitize"
 
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/mail"
 	"net/textproto"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 )
@@ -26,10 +30,39 @@ type Email struct {
 	Text        string       `json:"text"`
 	Html        string       `json:"html"`
 	Attachments []Attachment `json:"attachments"`
+	Unsubscribe bool         `json:"unsubscribe"`
+	Tracking    bool         `json:"tracking"`
+	Event       *Event       `json:"event"`
+
+	// Name of a stored template and the data used to render it
+	Template string                 `json:"template"`
+	Data     map[string]interface{} `json:"data"`
+
+	// Generator for the signed links in the email, which is required for
+	// unsubscribe headers and tracking
+	Links *Links `json:"-"`
+
+	// iCalendar object generated for the event
+	calendar string
 }
 
-// Write the headers for the email to the specified writer.
-func (e *Email) writeHeaders(w io.Writer, id, boundary string) error {
+// Paths of the endpoints for signed links.
+const (
+	UnsubscribePath = "/v1/unsubscribe"
+	OpenPath        = "/v1/track/open"
+	ClickPath       = "/v1/track/click"
+)
+
+var errLinks = errors.New("signed links are not configured")
+
+// Determine whether a separate body must be rendered for each recipient.
+func (e *Email) perRecipient() bool {
+	return e.Unsubscribe || e.Tracking
+}
+
+// Write the headers for the email to the specified writer. If the body is
+// for a single message, headers specific to its recipient are included.
+func (e *Email) writeHeaders(w io.Writer, id, boundary string, m *queue.Message) error {
 	headers := Headers{
 		"Message-Id":   fmt.Sprintf("<%s@hectane>", id),
 		"From":         e.From,
@@ -45,11 +78,74 @@ func (e *Email) writeHeaders(w io.Writer, id, boundary string) error {
 	if len(e.Cc) > 0 {
 		headers["Cc"] = strings.Join(e.Cc, ", ")
 	}
+	if e.Unsubscribe && m != nil {
+		// One-click unsubscribe (RFC 8058)
+		headers["List-Unsubscribe"] = fmt.Sprintf("<%s>", e.Links.URL(UnsubscribePath, url.Values{
+			"address": []string{m.To[0]},
+		}))
+		headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	}
 	return headers.Write(w)
 }
 
-// Write the body of the email to the specified writer.
-func (e *Email) writeBody(w *multipart.Writer) error {
+// Split the attachments into the inline images referenced by the HTML, which
+// are related to it, and the remaining attachments.
+func (e *Email) splitAttachments() ([]Attachment, []Attachment) {
+	var related, mixed []Attachment
+	for _, a := range e.Attachments {
+		if a.ContentID != "" && strings.Contains(e.Html, "cid:"+a.contentID()) {
+			related = append(related, a)
+		} else {
+			mixed = append(mixed, a)
+		}
+	}
+	return related, mixed
+}
+
+// Write the HTML part to the specified writer. If there are related inline
+// images, they are written with the HTML in a multipart/related part (RFC
+// 2387).
+func writeHTML(w *multipart.Writer, html string, related []Attachment) error {
+	a := Attachment{
+		ContentType: "text/html; charset=utf-8",
+		Content:     html,
+	}
+	if len(related) == 0 {
+		return a.Write(w)
+	}
+	var (
+		buff          = &bytes.Buffer{}
+		relatedWriter = multipart.NewWriter(buff)
+	)
+	p, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{
+			fmt.Sprintf("multipart/related; type=\"text/html\"; boundary=%s", relatedWriter.Boundary()),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := a.Write(relatedWriter); err != nil {
+		return err
+	}
+	for _, r := range related {
+		r.Inline = true
+		if err := r.Write(relatedWriter); err != nil {
+			return err
+		}
+	}
+	if err := relatedWriter.Close(); err != nil {
+		return err
+	}
+	_, err = io.Copy(p, buff)
+	return err
+}
+
+// Write the body of the email to the specified writer. If the body is for a
+// single message and tracking is enabled, the HTML is rewritten for its
+// recipient. Inline images referenced by the HTML are written with it. An
+// invitation is written as a text/calendar alternative.
+func (e *Email) writeBody(w *multipart.Writer, m *queue.Message, related []Attachment) error {
 	var (
 		buff      = &bytes.Buffer{}
 		altWriter = multipart.NewWriter(buff)
@@ -68,18 +164,28 @@ func (e *Email) writeBody(w *multipart.Writer) error {
 	if e.Html == "" {
 		e.Html = toHTML(e.Text)
 	}
+	html := e.Html
+	if e.Tracking && m != nil {
+		html = e.track(html, m)
+	}
 	if err := (Attachment{
 		ContentType: "text/plain; charset=utf-8",
 		Content:     e.Text,
 	}.Write(altWriter)); err != nil {
 		return err
 	}
-	if err := (Attachment{
-		ContentType: "text/html; charset=utf-8",
-		Content:     e.Html,
-	}.Write(altWriter)); err != nil {
+	if err := writeHTML(altWriter, html, related); err != nil {
 		return err
 	}
+	if e.calendar != "" {
+		if err := (Attachment{
+			ContentType: fmt.Sprintf("text/calendar; charset=utf-8; method=%s", e.Event.method()),
+			Content:     base64.StdEncoding.EncodeToString([]byte(e.calendar)),
+			Encoded:     true,
+		}.Write(altWriter)); err != nil {
+			return err
+		}
+	}
 	if err := altWriter.Close(); err != nil {
 		return err
 	}
@@ -90,55 +196,162 @@ func (e *Email) writeBody(w *multipart.Writer) error {
 }
 
 // Create an array of messages with the specified body.
-func (e *Email) newMessages(s *queue.Storage, from, body string) ([]*queue.Message, error) {
-	addresses := append(append(e.To, e.Cc...), e.Bcc...)
-	m, err := GroupAddressesByHost(addresses)
-	if err != nil {
-		return nil, err
-	}
+func (e *Email) newMessages(s *queue.Storage, hostMap map[string][]string, from, body string) ([]*queue.Message, error) {
 	messages := make([]*queue.Message, 0, 1)
-	for h, to := range m {
-		msg := &queue.Message{
-			Host: h,
-			From: from,
-			To:   to,
+	for h, to := range hostMap {
+		for _, msg := range s.NewMessages(h, from, to) {
+			if err := s.SaveMessage(msg, body); err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
 		}
-		if err := s.SaveMessage(msg, body); err != nil {
-			return nil, err
-		}
-		messages = append(messages, msg)
 	}
 	return messages, nil
 }
 
-// Convert the email into an array of messages grouped by host suitable for
-// delivery to the mail queue.
-func (e *Email) Messages(s *queue.Storage) ([]*queue.Message, error) {
-	from, err := mail.ParseAddress(mime.QEncoding.Encode("utf-8", e.From))
+// Prepare attachments that refer to uploads so that their content is read
+// from storage when the body is written. The filename and content type of the
+// upload are used unless the attachment overrides them. Attachments that have
+// already been prepared are skipped.
+func (e *Email) resolveUploads(s *queue.Storage) error {
+	for i := range e.Attachments {
+		a := &e.Attachments[i]
+		if a.Upload == "" || a.open != nil {
+			continue
+		}
+		u, err := s.UseUpload(a.Upload)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("upload \"%s\" does not exist", a.Upload)
+			}
+			return err
+		}
+		if a.Filename == "" {
+			a.Filename = u.Filename
+		}
+		if a.ContentType == "" {
+			a.ContentType = u.ContentType
+		}
+		id := u.ID
+		a.open = func() (io.ReadCloser, error) {
+			return s.OpenUpload(id)
+		}
+	}
+	return nil
+}
+
+// Write the headers and parts of the email to the body. The message is nil if
+// the body is shared by all recipients.
+func (e *Email) writeContent(w io.Writer, body string, m *queue.Message) error {
+	mpWriter := multipart.NewWriter(w)
+	if err := e.writeHeaders(w, body, mpWriter.Boundary(), m); err != nil {
+		return err
+	}
+	related, mixed := e.splitAttachments()
+	if err := e.writeBody(mpWriter, m, related); err != nil {
+		return err
+	}
+	b, _ := w.(*queue.BodyWriter)
+	for _, a := range mixed {
+		if a.part != nil && b != nil {
+			if err := a.writeShared(mpWriter, b); err != nil {
+				return err
+			}
+		} else if err := a.Write(mpWriter); err != nil {
+			return err
+		}
+	}
+	if e.calendar != "" {
+		if err := (Attachment{
+			Filename:    "invite.ics",
+			ContentType: "application/ics",
+			Content:     base64.StdEncoding.EncodeToString([]byte(e.calendar)),
+			Encoded:     true,
+		}.Write(mpWriter)); err != nil {
+			return err
+		}
+	}
+	return mpWriter.Close()
+}
+
+// Write the email to a new body, returning its ID. The body is removed if it
+// cannot be written.
+func (e *Email) writeMessage(s *queue.Storage, from string, m *queue.Message) (string, error) {
+	w, body, err := s.NewSignedBody(from)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if err := e.writeContent(w, body, m); err != nil {
+		w.Abort()
+		return "", err
 	}
-	w, body, err := s.NewBody()
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return body, nil
+}
+
+// Convert the email into an array of messages grouped by host suitable for
+// delivery to the mail queue. Recipients in the suppression list are omitted
+// and returned separately. If the email contains content specific to each
+// recipient, such as unsubscribe links or tracking, a message with its own
+// body is created for each one.
+func (e *Email) Messages(s *queue.Storage) ([]*queue.Message, []string, error) {
+	from, err := mail.ParseAddress(mime.QEncoding.Encode("utf-8", e.From))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	mpWriter := multipart.NewWriter(w)
-	if err := e.writeHeaders(w, body, mpWriter.Boundary()); err != nil {
-		return nil, err
+	if e.perRecipient() && e.Links == nil {
+		return nil, nil, errLinks
 	}
-	if err := e.writeBody(mpWriter); err != nil {
-		return nil, err
+	if err := e.resolveUploads(s); err != nil {
+		return nil, nil, err
 	}
 	for _, a := range e.Attachments {
-		if err := a.Write(mpWriter); err != nil {
-			return nil, err
+		if a.part != nil {
+			continue
+		}
+		if err := a.Validate(); err != nil {
+			return nil, nil, err
 		}
 	}
-	if err := mpWriter.Close(); err != nil {
-		return nil, err
+	if e.Event != nil {
+		if e.calendar, err = e.Event.iCalendar(e.Subject); err != nil {
+			return nil, nil, err
+		}
 	}
-	if err := w.Close(); err != nil {
-		return nil, err
+	hostMap, suppressed, err := groupDeliverable(s, append(append(e.To, e.Cc...), e.Bcc...))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hostMap) == 0 && len(suppressed) != 0 {
+		return []*queue.Message{}, suppressed, nil
+	}
+	if !e.perRecipient() {
+		body, err := e.writeMessage(s, from.Address, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		messages, err := e.newMessages(s, hostMap, from.Address, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return messages, suppressed, nil
+	}
+	messages := make([]*queue.Message, 0, 1)
+	for h, to := range hostMap {
+		for _, t := range to {
+			for _, m := range s.NewMessages(h, from.Address, []string{t}) {
+				body, err := e.writeMessage(s, from.Address, m)
+				if err != nil {
+					return nil, nil, err
+				}
+				if err := s.SaveMessage(m, body); err != nil {
+					return nil, nil, err
+				}
+				messages = append(messages, m)
+			}
+		}
 	}
-	return e.newMessages(s, from.Address, body)
+	return messages, suppressed, nil
 }
@@ -12,7 +12,9 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/mail"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -59,7 +61,7 @@ func emailToMessages(e *Email) ([]*queue.Message, []byte, error) {
 	}
 	defer os.RemoveAll(d)
 	s := queue.NewStorage(d)
-	m, err := e.Messages(s)
+	m, _, err := e.Messages(s)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -181,3 +183,142 @@ func TestEmailContent(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestEmailSuppressed(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := queue.NewStorage(d)
+	if _, err := s.Suppress("2@a.com", "test"); err != nil {
+		t.Fatal(err)
+	}
+	e := &Email{
+		From: "me@example.com",
+		To:   []string{"1@a.com", "2@A.com"},
+	}
+	m, suppressed, err := e.Messages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].To) != 1 || m[0].To[0] != "1@a.com" {
+		t.Fatalf("unexpected messages %v", m)
+	}
+	if len(suppressed) != 1 || suppressed[0] != "2@A.com" {
+		t.Fatalf("unexpected suppressed recipients %v", suppressed)
+	}
+	e.To = e.To[1:]
+	m, _, err = e.Messages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 0 {
+		t.Fatalf("%d != 0", len(m))
+	}
+}
+
+func TestEmailUnsubscribe(t *testing.T) {
+	e := &Email{
+		From:        "me@example.com",
+		To:          []string{"1@example.com", "2@example.com"},
+		Unsubscribe: true,
+	}
+	if _, _, err := emailToMessages(e); err != errLinks {
+		t.Fatalf("%v != %v", err, errLinks)
+	}
+	e.Links = &Links{
+		BaseURL: "https://example.com",
+		Secret:  []byte("secret"),
+	}
+	m, body, err := emailToMessages(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 {
+		t.Fatalf("%d != 2", len(m))
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := msg.Header.Get("List-Unsubscribe-Post"); v != "List-Unsubscribe=One-Click" {
+		t.Fatalf("unexpected List-Unsubscribe-Post %q", v)
+	}
+	u, err := url.Parse(strings.Trim(msg.Header.Get("List-Unsubscribe"), "<>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, ok := e.Links.Verify(u.Path, u.Query())
+	if !ok || v.Get("address") != m[0].To[0] {
+		t.Fatalf("unexpected List-Unsubscribe %s", u)
+	}
+}
+
+func TestEmailInlineImages(t *testing.T) {
+	description := &multipartDesc{
+		ContentType: "multipart/mixed",
+		Parts: []*multipartDesc{
+			{
+				ContentType: "multipart/alternative",
+				Parts: []*multipartDesc{
+					{
+						ContentType: "text/plain",
+						Content:     []byte("Logo"),
+					},
+					{
+						ContentType: "multipart/related",
+						Parts: []*multipartDesc{
+							{
+								ContentType: "text/html",
+								Content:     []byte(`<img src="cid:logo@example.com">`),
+							},
+							{
+								ContentType: "image/png",
+								Content:     []byte("bG9nbw=="),
+							},
+						},
+					},
+				},
+			},
+			{
+				ContentType: "text/plain",
+				Content:     []byte("data"),
+			},
+		},
+	}
+	_, body, err := emailToMessages(&Email{
+		From: "me@example.com",
+		To:   []string{"you@example.com"},
+		Text: "Logo",
+		Html: `<img src="cid:logo@example.com">`,
+		Attachments: []Attachment{
+			{
+				Filename:    "logo.png",
+				ContentType: "image/png",
+				Content:     "bG9nbw==",
+				Encoded:     true,
+				ContentID:   "<logo@example.com>",
+			},
+			{
+				Filename:    "data.txt",
+				ContentType: "text/plain",
+				Content:     "data",
+				ContentID:   "unused@example.com",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMultipart(m.Body, m.Header.Get("Content-Type"), description); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("Content-Id: <logo@example.com>")) {
+		t.Fatal("Content-ID missing")
+	}
+}
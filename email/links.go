@@ -0,0 +1,49 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+)
+
+// Name of the query parameter containing the signature of a link.
+const signatureParam = "sig"
+
+// Generator for signed links to the HTTP API. The signature covers the path
+// and the parameters so that they cannot be changed by the recipient.
+type Links struct {
+	BaseURL string
+	Secret  []byte
+}
+
+// Compute the signature for the specified path and parameters.
+func (l *Links) sign(path string, v url.Values) string {
+	h := hmac.New(sha256.New, l.Secret)
+	h.Write([]byte(path + "?" + v.Encode()))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Create a signed URL for the specified path and parameters.
+func (l *Links) URL(path string, v url.Values) string {
+	s := url.Values{}
+	for k, p := range v {
+		s[k] = p
+	}
+	s.Set(signatureParam, l.sign(path, v))
+	return strings.TrimSuffix(l.BaseURL, "/") + path + "?" + s.Encode()
+}
+
+// Verify the signature of the parameters for a path, returning the parameters
+// without the signature.
+func (l *Links) Verify(path string, v url.Values) (url.Values, bool) {
+	p := url.Values{}
+	for k, s := range v {
+		if k != signatureParam {
+			p[k] = s
+		}
+	}
+	expected := l.sign(path, p)
+	return p, hmac.Equal([]byte(v.Get(signatureParam)), []byte(expected))
+}
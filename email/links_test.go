@@ -0,0 +1,35 @@
+package email
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLinks(t *testing.T) {
+	l := &Links{
+		BaseURL: "https://example.com/",
+		Secret:  []byte("secret"),
+	}
+	u, err := url.Parse(l.URL("/v1/test", url.Values{"address": []string{"me@example.com"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "example.com" || u.Path != "/v1/test" {
+		t.Fatalf("unexpected URL %s", u)
+	}
+	v, ok := l.Verify(u.Path, u.Query())
+	if !ok {
+		t.Fatal("signature should be valid")
+	}
+	if a := v.Get("address"); a != "me@example.com" {
+		t.Fatalf("%s != me@example.com", a)
+	}
+	q := u.Query()
+	q.Set("address", "you@example.com")
+	if _, ok := l.Verify(u.Path, q); ok {
+		t.Fatal("signature should be invalid")
+	}
+	if _, ok := l.Verify("/v1/other", u.Query()); ok {
+		t.Fatal("signature should be invalid")
+	}
+}
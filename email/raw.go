@@ -11,32 +11,37 @@ type Raw struct {
 	Body string   `json:"body"`
 }
 
-// DeliverToQueue delivers raw messages to the queue.
-func (r *Raw) DeliverToQueue(q *queue.Queue) error {
-	w, body, err := q.Storage.NewBody()
+// DeliverToQueue delivers raw messages to the queue. The messages that were
+// delivered are returned along with any recipients that were omitted because
+// they are in the suppression list.
+func (r *Raw) DeliverToQueue(q *queue.Queue) ([]*queue.Message, []string, error) {
+	hostMap, suppressed, err := groupDeliverable(q.Storage, r.To)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if len(hostMap) == 0 && len(suppressed) != 0 {
+		return []*queue.Message{}, suppressed, nil
+	}
+	w, body, err := q.Storage.NewSignedBody(r.From)
+	if err != nil {
+		return nil, nil, err
 	}
 	if _, err := w.Write([]byte(r.Body)); err != nil {
-		return err
+		w.Abort()
+		return nil, nil, err
 	}
 	if err := w.Close(); err != nil {
-		return err
-	}
-	hostMap, err := GroupAddressesByHost(r.To)
-	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	messages := make([]*queue.Message, 0, 1)
 	for h, to := range hostMap {
-		m := &queue.Message{
-			Host: h,
-			From: r.From,
-			To:   to,
-		}
-		if err := q.Storage.SaveMessage(m, body); err != nil {
-			return err
+		for _, m := range q.Storage.NewMessages(h, r.From, to) {
+			if err := q.Storage.SaveMessage(m, body); err != nil {
+				return nil, nil, err
+			}
+			q.Deliver(m)
+			messages = append(messages, m)
 		}
-		q.Deliver(m)
 	}
-	return nil
+	return messages, suppressed, nil
 }
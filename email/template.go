@@ -0,0 +1,91 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"regexp"
+	"text/template"
+)
+
+var (
+	templateName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+	errTemplateName = errors.New("template name may only contain letters, digits, \"_\", \"-\" and \".\"")
+)
+
+// Named template for the subject and body of an email. The subject and text
+// use text/template syntax and the HTML uses html/template syntax so that
+// substituted values are escaped.
+type Template struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	Html    string `json:"html"`
+}
+
+// Parsed form of a template.
+type parsedTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// Parse each part of the template. Missing keys in the data are treated as
+// errors so that mistakes are reported rather than rendered.
+func (t *Template) parse() (*parsedTemplate, error) {
+	var (
+		p   = &parsedTemplate{}
+		err error
+	)
+	if p.subject, err = template.New("subject").Option("missingkey=error").Parse(t.Subject); err != nil {
+		return nil, err
+	}
+	if p.text, err = template.New("text").Option("missingkey=error").Parse(t.Text); err != nil {
+		return nil, err
+	}
+	if p.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(t.Html); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Ensure that the template has a valid name and that each part can be
+// parsed.
+func (t *Template) Validate() error {
+	if !templateName.MatchString(t.Name) {
+		return errTemplateName
+	}
+	_, err := t.parse()
+	return err
+}
+
+// Render the template with the email's data, replacing the parts of the
+// email for which the template has content.
+func (e *Email) Render(t *Template) error {
+	p, err := t.parse()
+	if err != nil {
+		return err
+	}
+	render := func(tmpl interface {
+		Execute(w io.Writer, data interface{}) error
+	}, source string, dest *string) error {
+		if source == "" {
+			return nil
+		}
+		b := &bytes.Buffer{}
+		if err := tmpl.Execute(b, e.Data); err != nil {
+			return err
+		}
+		*dest = b.String()
+		return nil
+	}
+	if err := render(p.subject, t.Subject, &e.Subject); err != nil {
+		return err
+	}
+	if err := render(p.text, t.Text, &e.Text); err != nil {
+		return err
+	}
+	return render(p.html, t.Html, &e.Html)
+}
@@ -0,0 +1,45 @@
+package email
+
+import (
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tmpl := &Template{
+		Name:    "welcome",
+		Subject: "Welcome, {{.name}}",
+		Html:    "<p>Hello {{.name}}</p>",
+	}
+	if err := tmpl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e := &Email{
+		Text: "Plain",
+		Data: map[string]interface{}{
+			"name": "<Bob>",
+		},
+	}
+	if err := e.Render(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if e.Subject != "Welcome, <Bob>" {
+		t.Fatalf("unexpected subject %s", e.Subject)
+	}
+	if e.Text != "Plain" {
+		t.Fatalf("unexpected text %s", e.Text)
+	}
+	if e.Html != "<p>Hello &lt;Bob&gt;</p>" {
+		t.Fatalf("unexpected HTML %s", e.Html)
+	}
+	if err := (&Email{}).Render(tmpl); err == nil {
+		t.Fatal("error expected for missing data")
+	}
+	for _, tmpl := range []*Template{
+		{Name: "../x"},
+		{Name: "x", Text: "{{.name"},
+	} {
+		if err := tmpl.Validate(); err == nil {
+			t.Fatalf("error expected for %+v", tmpl)
+		}
+	}
+}
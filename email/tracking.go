@@ -0,0 +1,47 @@
+package email
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+)
+
+var (
+	trackLinks = regexp.MustCompile(`(?i)(<a\s[^>]*?href\s*=\s*)(?:"(https?://[^"]*)"|'(https?://[^']*)')`)
+	bodyEnd    = regexp.MustCompile(`(?i)</body\s*>`)
+)
+
+// Create the parameters identifying the message and recipient in a tracking
+// link.
+func trackingValues(m *queue.Message) url.Values {
+	return url.Values{
+		"message_id": []string{m.ID()},
+		"recipient":  []string{m.To[0]},
+	}
+}
+
+// Rewrite the links in the HTML to signed redirect URLs and add a tracking
+// pixel so that clicks and opens by the message's recipient are recorded.
+func (e *Email) track(data string, m *queue.Message) string {
+	data = trackLinks.ReplaceAllStringFunc(data, func(s string) string {
+		p := trackLinks.FindStringSubmatch(s)
+		target := p[2]
+		if target == "" {
+			target = p[3]
+		}
+		v := trackingValues(m)
+		v.Set("url", html.UnescapeString(target))
+		return fmt.Sprintf(`%s"%s"`, p[1], html.EscapeString(e.Links.URL(ClickPath, v)))
+	})
+	pixel := fmt.Sprintf(
+		`<img src="%s" width="1" height="1" alt="" style="display:none">`,
+		html.EscapeString(e.Links.URL(OpenPath, trackingValues(m))),
+	)
+	if loc := bodyEnd.FindStringIndex(data); loc != nil {
+		return data[:loc[0]] + pixel + data[loc[0]:]
+	}
+	return data + pixel
+}
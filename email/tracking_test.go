@@ -0,0 +1,55 @@
+package email
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTrack(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		s = queue.NewStorage(d)
+		m = s.NewMessages("example.com", "me@example.com", []string{"you@example.com"})[0]
+		e = &Email{
+			Tracking: true,
+			Links: &Links{
+				BaseURL: "https://example.com",
+				Secret:  []byte("secret"),
+			},
+		}
+		data = e.track(`<html><body><a class="x" href="https://example.org/?a=1&amp;b=2">Link</a> <a href="mailto:me@example.com">Mail</a></body></html>`, m)
+	)
+	links := regexp.MustCompile(`(?:href|src)="([^"]*)"`).FindAllStringSubmatch(data, -1)
+	if len(links) != 3 || links[1][1] != "mailto:me@example.com" {
+		t.Fatalf("unexpected HTML %s", data)
+	}
+	if !strings.HasSuffix(data, `style="display:none"></body></html>`) {
+		t.Fatalf("tracking pixel not before </body>: %s", data)
+	}
+	for i, path := range map[int]string{0: ClickPath, 2: OpenPath} {
+		u, err := url.Parse(strings.Replace(links[i][1], "&amp;", "&", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := e.Links.Verify(u.Path, u.Query())
+		if !ok || u.Path != path {
+			t.Fatalf("invalid link %s", u)
+		}
+		if v.Get("message_id") != m.ID() || v.Get("recipient") != "you@example.com" {
+			t.Fatalf("unexpected parameters %v", v)
+		}
+		if path == ClickPath && v.Get("url") != "https://example.org/?a=1&b=2" {
+			t.Fatalf("unexpected URL %s", v.Get("url"))
+		}
+	}
+}
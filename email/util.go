@@ -1,6 +1,8 @@
 package email
 
 import (
+	"github.com/hectane/hectane/queue"
+
 	"fmt"
 	"html"
 	"net/mail"
@@ -32,6 +34,29 @@ func GroupAddressesByHost(addrs []string) (map[string][]string, error) {
 	return m, nil
 }
 
+// Group a list of email addresses by their host, omitting addresses in the
+// suppression list. The omitted addresses are returned separately.
+func groupDeliverable(s *queue.Storage, addrs []string) (map[string][]string, []string, error) {
+	m, err := GroupAddressesByHost(addrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var suppressed []string
+	for h, to := range m {
+		allowed, omitted, err := s.FilterSuppressed(to)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(allowed) == 0 {
+			delete(m, h)
+		} else {
+			m[h] = allowed
+		}
+		suppressed = append(suppressed, omitted...)
+	}
+	return m, suppressed, nil
+}
+
 // Convert the specified text to its HTML equivalent, preserving formatting
 // where possible and converting URLs to <a> elements.
 func toHTML(data string) string {
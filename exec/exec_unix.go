@@ -2,8 +2,9 @@
 
 package exec
 
-// Run the application until terminated by a signal.
-func Exec() error {
-	execSignal()
+// Run the application until terminated by a signal or until the drain channel
+// is closed. The reload function is invoked when SIGHUP is received.
+func Exec(drain <-chan bool, reload func()) error {
+	execSignal(drain, reload)
 	return nil
 }
@@ -9,23 +9,34 @@ const (
 	ServiceName = "Hectane"
 )
 
-// A service must implement the svc.Handler interface.
-type service struct{}
+// A service must implement the svc.Handler interface. The service stops when
+// the drain channel is closed and reloads when its parameters change.
+type service struct {
+	drain  <-chan bool
+	reload func()
+}
 
 // Run the service, responding to control commands as necessary.
 func (s *service) Execute(args []string, chChan <-chan svc.ChangeRequest, stChan chan<- svc.Status) (bool, uint32) {
 	logrus.Debug("service started")
 	stChan <- svc.Status{
 		State:   svc.Running,
-		Accepts: svc.AcceptStop | svc.AcceptShutdown,
+		Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange,
 	}
 loop:
 	for {
-		c := <-chChan
-		switch c.Cmd {
-		case svc.Interrogate:
-			stChan <- c.CurrentStatus
-		case svc.Stop, svc.Shutdown:
+		select {
+		case c := <-chChan:
+			switch c.Cmd {
+			case svc.Interrogate:
+				stChan <- c.CurrentStatus
+			case svc.ParamChange:
+				s.reload()
+			case svc.Stop, svc.Shutdown:
+				stChan <- svc.Status{State: svc.StopPending}
+				break loop
+			}
+		case <-s.drain:
 			stChan <- svc.Status{State: svc.StopPending}
 			break loop
 		}
@@ -35,16 +46,17 @@ loop:
 }
 
 // If the application is running in an interactive session, run until
-// terminated. Otherwise, run the application as a Windows service.
-func Exec() error {
+// terminated. Otherwise, run the application as a Windows service. In either
+// case, closing the drain channel causes the function to return.
+func Exec(drain <-chan bool, reload func()) error {
 	isInteractive, err := svc.IsAnInteractiveSession()
 	if err != nil {
 		return err
 	}
 	if !isInteractive {
-		return svc.Run(ServiceName, &service{})
+		return svc.Run(ServiceName, &service{drain: drain, reload: reload})
 	} else {
-		execSignal()
+		execSignal(drain, reload)
 		return nil
 	}
 }
@@ -6,9 +6,21 @@ import (
 	"syscall"
 )
 
-// Run until SIGINT is received.
-func execSignal() {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
+// Run until SIGINT or SIGTERM is received or a drain is requested. SIGHUP
+// causes the configuration to be reloaded.
+func execSignal(drain <-chan bool, reload func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case s := <-c:
+			if s == syscall.SIGHUP {
+				reload()
+				continue
+			}
+		case <-drain:
+		}
+		return
+	}
 }
@@ -8,33 +8,37 @@ import (
 	"github.com/hectane/hectane/log"
 	"github.com/hectane/hectane/queue"
 	"github.com/hectane/hectane/smtp"
+	"github.com/sirupsen/logrus"
 
-	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 )
 
 // Display usage information for the application.
 func printUsage() {
-	fmt.Fprintf(os.Stderr, "USAGE\n\thectane [flags] [command]\n\n")
+	fmt.Fprintf(os.Stderr, "USAGE\n\thectane [flags] [command [command flags]]\n\n")
 	fmt.Fprintf(os.Stderr, "COMMANDS\n")
 	cmd.Print()
 	fmt.Fprintf(os.Stderr, "\nFLAGS\n")
 	flag.PrintDefaults()
 }
 
-// Run the application.
+// Run the application. When the application is asked to terminate, new mail
+// is refused and in-flight transactions are given time to finish.
 func runApplication(config *cfg.Config) error {
 	if err := log.Init(&config.Log); err != nil {
 		return err
 	}
 	defer log.Cleanup()
+	timeout := time.Duration(config.DrainTimeout) * time.Second
 	q, err := queue.NewQueue(&config.Queue)
 	if err != nil {
 		return err
 	}
-	defer q.Stop()
+	defer q.Drain(timeout)
 	a := api.New(&config.API, q)
 	if err = a.Start(); err != nil {
 		return err
@@ -44,17 +48,51 @@ func runApplication(config *cfg.Config) error {
 	if err != nil {
 		return err
 	}
-	defer s.Close()
-	if err = exec.Exec(); err != nil {
+	defer s.Drain(timeout)
+	var (
+		m      sync.Mutex
+		l      = logrus.WithField("context", "Config")
+		reload = func() error {
+			m.Lock()
+			defer m.Unlock()
+			// Everything is prepared before anything is applied so that
+			// an error leaves the entire application unchanged
+			var applyQueue, applyAPI, applySMTP func()
+			c, err := config.Reload()
+			if err == nil {
+				applyQueue, err = q.PrepareReload(&c.Queue)
+			}
+			if err == nil {
+				applyAPI, err = a.PrepareReload(&c.API)
+			}
+			if err == nil {
+				applySMTP, err = s.PrepareReload(&c.SMTP)
+			}
+			if err != nil {
+				l.Error(err.Error())
+				return err
+			}
+			applyQueue()
+			applyAPI()
+			applySMTP()
+			config = c
+			l.Info("configuration reloaded")
+			return nil
+		}
+	)
+	a.OnReload(reload)
+	if err = exec.Exec(a.DrainRequested(), func() { reload() }); err != nil {
 		return err
 	}
+	a.Drain()
 	return nil
 }
 
 // This needs to be a separate function from main in order to ensure that the
 // deferred statements are run while still allowing os.Exit() to be given an
-// error code. If a single argument was specified, it's a command. Otherwise,
-// run the application using the current platform's execution environment.
+// error code. If arguments were specified, the first is a command and the rest
+// are passed to it. Otherwise, run the application using the current
+// platform's execution environment.
 func run() error {
 	cmd.Init()
 	flag.Usage = printUsage
@@ -62,14 +100,10 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	switch {
-	case flag.NArg() == 0:
+	if flag.NArg() == 0 {
 		return runApplication(config)
-	case flag.NArg() == 1:
-		return cmd.Exec(flag.Args()[0], config)
-	default:
-		return errors.New("single command expected")
 	}
+	return cmd.Exec(flag.Arg(0), flag.Args()[1:], config)
 }
 
 func main() {
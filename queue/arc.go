@@ -0,0 +1,619 @@
+package queue
+
+import (
+	"github.com/emersion/go-msgauth/dkim"
+
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/mail"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	arcSeal                  = "ARC-Seal"
+	arcMessageSignature      = "ARC-Message-Signature"
+	arcAuthenticationResults = "ARC-Authentication-Results"
+
+	// Maximum number of ARC sets in a message (RFC 8617, section 4.2.1)
+	arcMaxInstances = 50
+
+	// Chain validation status values
+	arcNone = "none"
+	arcPass = "pass"
+	arcFail = "fail"
+)
+
+var (
+	errARCInstance = errors.New("invalid ARC instance")
+	errARCKey      = errors.New("invalid public key record")
+	errARCBodyHash = errors.New("body hash does not match")
+	errARCSequence = errors.New("ARC sets are incomplete or duplicated")
+
+	arcResultsInstanceRegexp = regexp.MustCompile(`^\s*i\s*=\s*(\d+)\s*(;|$)`)
+	tagBRegexp               = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+// Configuration for ARC sealing of mail received for a domain. The settings
+// for the key are the same as for DKIM signatures; the signing domain is the
+// receiving domain unless specified.
+type ARCConfig struct {
+	DKIMConfig
+
+	// Identifier for this server in authentication results (the hostname if
+	// empty)
+	AuthServID string `json:"authserv-id"`
+}
+
+// Single header field in a message. The raw field includes the name and the
+// terminating CRLF.
+type headerField struct {
+	name string
+	raw  string
+}
+
+// Retrieve the value of the header field, excluding the terminating CRLF.
+func (h *headerField) value() string {
+	v := h.raw[len(h.name)+1:]
+	return strings.TrimSuffix(v, "\r\n")
+}
+
+// Split a message into its header fields and body. Line endings are
+// normalized to CRLF since that is how the message is transmitted.
+func parseMessage(message []byte) ([]*headerField, []byte) {
+	var (
+		lines  = strings.SplitAfter(string(message), "\n")
+		fields []*headerField
+		i      int
+	)
+	for ; i < len(lines); i++ {
+		l := strings.TrimRight(lines[i], "\r\n")
+		if l == "" {
+			i++
+			break
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(fields) != 0 {
+			fields[len(fields)-1].raw += l + "\r\n"
+			continue
+		}
+		n := strings.Index(l, ":")
+		if n == -1 {
+			continue
+		}
+		fields = append(fields, &headerField{
+			name: strings.TrimSpace(l[:n]),
+			raw:  l + "\r\n",
+		})
+	}
+	var body bytes.Buffer
+	for _, l := range lines[i:] {
+		if strings.HasSuffix(l, "\n") {
+			body.WriteString(strings.TrimRight(l, "\r\n") + "\r\n")
+		} else {
+			body.WriteString(l)
+		}
+	}
+	return fields, body.Bytes()
+}
+
+// Collapse each run of whitespace into a single space.
+func collapseWhitespace(s string) string {
+	var (
+		b     strings.Builder
+		space bool
+	)
+	for _, c := range s {
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(c)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// Canonicalize a raw header field using the specified algorithm.
+func canonicalizeHeader(raw, c string) string {
+	if c != "relaxed" {
+		return raw
+	}
+	var (
+		n     = strings.Index(raw, ":")
+		name  = strings.ToLower(strings.TrimSpace(raw[:n]))
+		value = strings.Replace(raw[n+1:], "\r\n", "", -1)
+	)
+	return name + ":" + strings.TrimSpace(collapseWhitespace(value)) + "\r\n"
+}
+
+// Canonicalize a message body using the specified algorithm. The body must
+// use CRLF line endings.
+func canonicalizeBody(body []byte, c string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if c == "relaxed" {
+		for i, l := range lines {
+			lines[i] = strings.TrimRight(collapseWhitespace(l), " ")
+		}
+	}
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if c == "relaxed" {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// Parse a tag list (RFC 6376, section 3.2). Whitespace is removed from values.
+func parseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(value, ";") {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) == 2 {
+			tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+		}
+	}
+	return tags
+}
+
+// Remove the value of the b= tag from a header field.
+func stripSignature(raw string) string {
+	n := strings.Index(raw, ":")
+	return raw[:n+1] + tagBRegexp.ReplaceAllString(raw[n+1:], "$1$2")
+}
+
+// Hash the specified header fields, selecting instances from the bottom of
+// the header when a name appears more than once (RFC 6376, section 5.4.2).
+func hashHeaders(h hash.Hash, fields []*headerField, keys []string, c string) {
+	used := make(map[*headerField]bool)
+	for _, k := range keys {
+		for i := len(fields) - 1; i >= 0; i-- {
+			f := fields[i]
+			if !used[f] && strings.EqualFold(f.name, k) {
+				used[f] = true
+				h.Write([]byte(canonicalizeHeader(f.raw, c)))
+				break
+			}
+		}
+	}
+}
+
+// Fold a base64 value so that no line is excessively long.
+func foldSignature(s string) string {
+	var parts []string
+	for len(s) > 72 {
+		parts = append(parts, s[:72])
+		s = s[72:]
+	}
+	return strings.Join(append(parts, s), "\r\n\t")
+}
+
+// ARC set found in a message.
+type arcSet struct {
+	aar, ams, as *headerField
+}
+
+// Retrieve a pointer to the member of the set for the specified header field
+// name, or nil if it is not an ARC header field.
+func (s *arcSet) field(name string) **headerField {
+	switch {
+	case strings.EqualFold(name, arcSeal):
+		return &s.as
+	case strings.EqualFold(name, arcMessageSignature):
+		return &s.ams
+	case strings.EqualFold(name, arcAuthenticationResults):
+		return &s.aar
+	default:
+		return nil
+	}
+}
+
+// Determine the instance of an ARC header field. The seal and message
+// signature are tag lists in which the tags may appear in any order; the
+// authentication results always begin with the instance (RFC 8617, section
+// 4.1.1).
+func arcInstance(f *headerField) (int, error) {
+	var v string
+	if strings.EqualFold(f.name, arcAuthenticationResults) {
+		m := arcResultsInstanceRegexp.FindStringSubmatch(f.value())
+		if m == nil {
+			return 0, errARCInstance
+		}
+		v = m[1]
+	} else {
+		v = parseTags(f.value())["i"]
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 1 || i > arcMaxInstances {
+		return 0, errARCInstance
+	}
+	return i, nil
+}
+
+// Collect the ARC sets in a message by instance. An error is returned if an
+// instance is invalid or has missing or duplicate header fields.
+func arcSets(fields []*headerField) ([]*arcSet, error) {
+	var (
+		sets = make(map[int]*arcSet)
+		max  = 0
+	)
+	for _, f := range fields {
+		if (&arcSet{}).field(f.name) == nil {
+			continue
+		}
+		i, err := arcInstance(f)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := sets[i]
+		if !ok {
+			s = &arcSet{}
+			sets[i] = s
+		}
+		dest := s.field(f.name)
+		if *dest != nil {
+			return nil, errARCSequence
+		}
+		*dest = f
+		if i > max {
+			max = i
+		}
+	}
+	l := make([]*arcSet, max)
+	for i := range l {
+		s, ok := sets[i+1]
+		if !ok || s.aar == nil || s.ams == nil || s.as == nil {
+			return nil, errARCSequence
+		}
+		l[i] = s
+	}
+	return l, nil
+}
+
+// Sealer adding ARC sets to messages received for a domain.
+type arcSealer struct {
+	domain     string
+	selector   string
+	algo       string
+	key        crypto.Signer
+	headers    []string
+	authServID string
+}
+
+// Create a sealer for the specified receiving domain.
+func newARCSealer(domain string, c *ARCConfig) (*arcSealer, error) {
+	data, err := c.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	key, algo, err := parseDKIMKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if c.Algorithm != "" && c.Algorithm != algo+"-sha256" {
+		return nil, errDKIMAlgorithm
+	}
+	if c.Selector == "" {
+		return nil, errors.New("selector is required")
+	}
+	if c.Domain != "" {
+		domain = c.Domain
+	}
+	headers := c.Headers
+	if len(headers) == 0 {
+		headers = dkimHeaders
+	}
+	authServID := c.AuthServID
+	if authServID == "" {
+		if authServID, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	return &arcSealer{
+		domain:     domain,
+		selector:   c.Selector,
+		algo:       algo + "-sha256",
+		key:        key,
+		headers:    headers,
+		authServID: authServID,
+	}, nil
+}
+
+// Sign the hash of the canonicalized data.
+func (s *arcSealer) sign(h hash.Hash) (string, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := s.key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Create the ARC-Message-Signature for instance i.
+func (s *arcSealer) messageSignature(i int, fields []*headerField, body []byte) (string, error) {
+	bh := sha256.Sum256(canonicalizeBody(body, "relaxed"))
+	raw := fmt.Sprintf(
+		"%s: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		arcMessageSignature,
+		i,
+		s.algo,
+		s.domain,
+		s.selector,
+		time.Now().Unix(),
+		strings.Join(s.headers, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]),
+	)
+	h := sha256.New()
+	hashHeaders(h, fields, s.headers, "relaxed")
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(raw+"\r\n", "relaxed"), "\r\n")))
+	b, err := s.sign(h)
+	if err != nil {
+		return "", err
+	}
+	return raw + foldSignature(b) + "\r\n", nil
+}
+
+// Create the ARC-Seal for instance i covering the specified sets, the last
+// of which is the set being added and has no seal yet.
+func (s *arcSealer) seal(i int, cv string, sets []*arcSet) (string, error) {
+	raw := fmt.Sprintf(
+		"%s: i=%d; a=%s; cv=%s; d=%s; s=%s;\r\n\tt=%d; b=",
+		arcSeal,
+		i,
+		s.algo,
+		cv,
+		s.domain,
+		s.selector,
+		time.Now().Unix(),
+	)
+	h := sha256.New()
+	for _, set := range sets {
+		h.Write([]byte(canonicalizeHeader(set.aar.raw, "relaxed")))
+		h.Write([]byte(canonicalizeHeader(set.ams.raw, "relaxed")))
+		if set.as != nil {
+			h.Write([]byte(canonicalizeHeader(set.as.raw, "relaxed")))
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(raw+"\r\n", "relaxed"), "\r\n")))
+	b, err := s.sign(h)
+	if err != nil {
+		return "", err
+	}
+	return raw + foldSignature(b) + "\r\n", nil
+}
+
+// Retrieve the public key published for the specified DKIM selector and
+// domain using the provided function to look up TXT records.
+func LookupDKIMKey(lookupTXT func(string) ([]string, error), selector, domain string) (crypto.PublicKey, error) {
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	tags := parseTags(strings.Join(txts, ""))
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(data) == 0 {
+		return nil, errARCKey
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if k, err := x509.ParsePKIXPublicKey(data); err == nil {
+			return k, nil
+		}
+		return x509.ParsePKCS1PublicKey(data)
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errARCKey
+		}
+		return ed25519.PublicKey(data), nil
+	default:
+		return nil, errARCKey
+	}
+}
+
+// Verify a signature using the public key referenced by the tags.
+func verifySignature(lookupTXT func(string) ([]string, error), tags map[string]string, h hash.Hash) error {
+	key, err := LookupDKIMKey(lookupTXT, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return errDKIMAlgorithm
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), sig)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(k, h.Sum(nil), sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	default:
+		return errARCKey
+	}
+}
+
+// Verify the ARC-Message-Signature in the specified set.
+func verifyMessageSignature(lookupTXT func(string) ([]string, error), set *arcSet, fields []*headerField, body []byte) error {
+	var (
+		tags = parseTags(set.ams.value())
+		c    = strings.SplitN(tags["c"], "/", 2)
+	)
+	if len(c) == 1 {
+		c = append(c, "simple")
+	}
+	bh := sha256.Sum256(canonicalizeBody(body, c[1]))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errARCBodyHash
+	}
+	h := sha256.New()
+	hashHeaders(h, fields, strings.Split(tags["h"], ":"), c[0])
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(stripSignature(set.ams.raw), c[0]), "\r\n")))
+	return verifySignature(lookupTXT, tags, h)
+}
+
+// Verify the ARC-Seal of the last of the specified sets.
+func verifySeal(lookupTXT func(string) ([]string, error), sets []*arcSet) error {
+	h := sha256.New()
+	for i, set := range sets {
+		h.Write([]byte(canonicalizeHeader(set.aar.raw, "relaxed")))
+		h.Write([]byte(canonicalizeHeader(set.ams.raw, "relaxed")))
+		if i != len(sets)-1 {
+			h.Write([]byte(canonicalizeHeader(set.as.raw, "relaxed")))
+		}
+	}
+	last := sets[len(sets)-1].as
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(stripSignature(last.raw), "relaxed"), "\r\n")))
+	return verifySignature(lookupTXT, parseTags(last.value()), h)
+}
+
+// Validate the ARC chain in a message (RFC 8617, section 5.2), returning the
+// chain validation status and the sets in the chain.
+func validateARC(lookupTXT func(string) ([]string, error), fields []*headerField, body []byte) (string, []*arcSet) {
+	sets, err := arcSets(fields)
+	if err != nil {
+		return arcFail, nil
+	}
+	if len(sets) == 0 {
+		return arcNone, nil
+	}
+	for i, set := range sets {
+		cv := parseTags(set.as.value())["cv"]
+		if (i == 0 && cv != arcNone) || (i != 0 && cv != arcPass) {
+			return arcFail, sets
+		}
+	}
+	if err := verifyMessageSignature(lookupTXT, sets[len(sets)-1], fields, body); err != nil {
+		return arcFail, sets
+	}
+	for i := len(sets); i > 0; i-- {
+		if err := verifySeal(lookupTXT, sets[:i]); err != nil {
+			return arcFail, sets
+		}
+	}
+	return arcPass, sets
+}
+
+// Verify the DKIM signatures in a message and describe the results in the
+// format used by Authentication-Results (RFC 8601).
+func dkimResults(lookupTXT func(string) ([]string, error), message []byte) []string {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(message), &dkim.VerifyOptions{
+		LookupTXT: lookupTXT,
+	})
+	if err != nil && len(verifications) == 0 {
+		return []string{"dkim=permerror"}
+	}
+	if len(verifications) == 0 {
+		return []string{"dkim=none"}
+	}
+	var results []string
+	for _, v := range verifications {
+		result := "pass"
+		switch {
+		case v.Err == nil:
+		case dkim.IsTempFail(v.Err):
+			result = "temperror"
+		case dkim.IsPermFail(v.Err):
+			result = "permerror"
+		default:
+			result = "fail"
+		}
+		results = append(results, fmt.Sprintf("dkim=%s header.d=%s", result, v.Domain))
+	}
+	return results
+}
+
+// Find the ARC sealer for the first of the recipients whose domain has one.
+func (r *DKIMRegistry) sealerFor(recipients []string) *arcSealer {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	for _, to := range recipients {
+		a, err := mail.ParseAddress(to)
+		if err != nil {
+			continue
+		}
+		domain := strings.ToLower(a.Address[strings.LastIndex(a.Address, "@")+1:])
+		if s, ok := r.sealers[domain]; ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// Add an ARC set to a message received for the specified recipients if ARC
+// sealing is configured for one of their domains. Messages whose chain is
+// malformed, was already marked as failed or is at its maximum length are
+// returned unmodified.
+func (r *DKIMRegistry) Seal(recipients []string, message []byte) ([]byte, error) {
+	if r == nil {
+		return message, nil
+	}
+	s := r.sealerFor(recipients)
+	if s == nil {
+		return message, nil
+	}
+	fields, body := parseMessage(message)
+	cv, sets := validateARC(r.lookupTXT, fields, body)
+	if (cv == arcFail && len(sets) == 0) || len(sets) >= arcMaxInstances ||
+		(len(sets) != 0 && parseTags(sets[len(sets)-1].as.value())["cv"] == arcFail) {
+		r.log.Debug("not sealing message with failed or full ARC chain")
+		return message, nil
+	}
+	i := len(sets) + 1
+	results := append(dkimResults(r.lookupTXT, message), "arc="+cv)
+	aar := &headerField{
+		name: arcAuthenticationResults,
+		raw: fmt.Sprintf(
+			"%s: i=%d; %s;\r\n\t%s\r\n",
+			arcAuthenticationResults,
+			i,
+			s.authServID,
+			strings.Join(results, ";\r\n\t"),
+		),
+	}
+	ams, err := s.messageSignature(i, fields, body)
+	if err != nil {
+		return nil, err
+	}
+	// When the chain has failed, the seal only covers the set being added
+	// (RFC 8617, section 5.1.2)
+	set := &arcSet{
+		aar: aar,
+		ams: &headerField{name: arcMessageSignature, raw: ams},
+	}
+	if cv == arcFail {
+		sets = nil
+	}
+	as, err := s.seal(i, cv, append(sets, set))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(as+ams+aar.raw), message...), nil
+}
@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"github.com/emersion/go-msgauth/dkim"
+
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Seal a message for the specified recipient and validate the resulting
+// chain, returning the sealed message.
+func sealAndValidate(t *testing.T, r *DKIMRegistry, to string, message []byte, cv string) []byte {
+	sealed, err := r.Seal([]string{to}, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, body := parseMessage(sealed)
+	if v, _ := validateARC(r.lookupTXT, fields, body); v != cv {
+		t.Fatalf("%s != %s", v, cv)
+	}
+	return sealed
+}
+
+func TestARC(t *testing.T) {
+	edKey, edPub, err := generateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDKIMRegistry(&Config{
+		DKIMConfigs: map[string]DKIMConfigList{
+			"example.org": {
+				{
+					PrivateKey: privKey,
+					Selector:   "rsa",
+				},
+			},
+		},
+		ARCConfigs: map[string]ARCConfig{
+			"example.net": {
+				DKIMConfig: DKIMConfig{
+					PrivateKey: privKey,
+					Selector:   "rsa",
+				},
+				AuthServID: "mx.example.net",
+			},
+			"example.com": {
+				DKIMConfig: DKIMConfig{
+					PrivateKey: edKey,
+					Selector:   "ed",
+				},
+				AuthServID: "mx.example.com",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]string{
+		"rsa._domainkey.example.org": "v=DKIM1; k=rsa; p=" + rsaPublicKey,
+		"rsa._domainkey.example.net": "v=DKIM1; k=rsa; p=" + rsaPublicKey,
+		"ed._domainkey.example.com":  "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+	}
+	r.lookupTXT = func(domain string) ([]string, error) {
+		return []string{records[domain]}, nil
+	}
+	headers, err := r.Sign(sampleFrom, strings.NewReader(sampleMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte(headers + sampleMessage)
+	unsealed, err := r.Seal([]string{"user@example.invalid"}, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unsealed, message) {
+		t.Fatal("message should not be sealed")
+	}
+	sealed := sealAndValidate(t, r, "user@example.net", message, arcPass)
+	if !bytes.Contains(sealed, []byte("dkim=pass header.d=example.org")) {
+		t.Fatal("DKIM result expected")
+	}
+	if !bytes.Contains(sealed, []byte("arc=none")) {
+		t.Fatal("ARC result expected")
+	}
+	sealed = sealAndValidate(t, r, "user@example.com", sealed, arcPass)
+	if !bytes.Contains(sealed, []byte("i=2; mx.example.com")) {
+		t.Fatal("second instance expected")
+	}
+	tampered := bytes.Replace(sealed, []byte("Some stuff"), []byte("Other stuff"), 1)
+	fields, body := parseMessage(tampered)
+	if v, _ := validateARC(r.lookupTXT, fields, body); v != arcFail {
+		t.Fatalf("%s != %s", v, arcFail)
+	}
+	sealed = sealAndValidate(t, r, "user@example.net", tampered, arcFail)
+	if !bytes.Contains(sealed, []byte("i=3; a=rsa-sha256; cv=fail")) {
+		t.Fatal("failed seal expected")
+	}
+	resealed, err := r.Seal([]string{"user@example.net"}, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resealed, sealed) {
+		t.Fatal("failed chain should not be sealed again")
+	}
+}
+
+func TestARCSetsTagOrder(t *testing.T) {
+	message := []byte("ARC-Seal: a=rsa-sha256; cv=none; d=example.net; s=rsa;\r\n" +
+		"\ti=1; b=AAAA\r\n" +
+		"ARC-Message-Signature: a=rsa-sha256; c=relaxed/relaxed; d=example.net;\r\n" +
+		"\ts=rsa; h=from; bh=AAAA; b=AAAA; i=1\r\n" +
+		"ARC-Authentication-Results: i=1; mx.example.net; dkim=pass header.i=@example.org\r\n" +
+		"From: me@example.org\r\n\r\nBody\r\n")
+	fields, _ := parseMessage(message)
+	sets, err := arcSets(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 1 {
+		t.Fatalf("%d != 1", len(sets))
+	}
+	fields, _ = parseMessage(bytes.Replace(message, []byte("i=1; b="), []byte("i=0; b="), 1))
+	if _, err := arcSets(fields); err != errARCInstance {
+		t.Fatalf("%v != %v", err, errARCInstance)
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	if h := canonicalizeHeader("SubJect :  A \r\n\t b  \r\n", "relaxed"); h != "subject:A b\r\n" {
+		t.Fatalf("%q != %q", h, "subject:A b\r\n")
+	}
+	for _, test := range []struct {
+		body, c, expected string
+	}{
+		{"", "simple", "\r\n"},
+		{"", "relaxed", ""},
+		{"a  b \r\n\r\n\r\n", "relaxed", "a b\r\n"},
+		{"a  b \r\n\r\n", "simple", "a  b \r\n"},
+	} {
+		if b := string(canonicalizeBody([]byte(test.body), test.c)); b != test.expected {
+			t.Fatalf("%q != %q", b, test.expected)
+		}
+	}
+}
+
+// Canonicalization example from RFC 6376, section 3.4.5.
+func TestCanonicalizeRFC6376(t *testing.T) {
+	var headers string
+	for _, h := range []string{"A: X\r\n", "B : Y\t\r\n\tZ  \r\n"} {
+		headers += canonicalizeHeader(h, "relaxed")
+	}
+	if headers != "a:X\r\nb:Y Z\r\n" {
+		t.Fatalf("%q != %q", headers, "a:X\r\nb:Y Z\r\n")
+	}
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+	for c, expected := range map[string]string{
+		"simple":  " C \r\nD \t E\r\n",
+		"relaxed": " C\r\nD E\r\n",
+	} {
+		if b := string(canonicalizeBody(body, c)); b != expected {
+			t.Fatalf("%q != %q", b, expected)
+		}
+	}
+}
+
+// Verify signatures created by an independent DKIM implementation with the
+// code used to verify ARC-Message-Signature header fields, which share their
+// canonicalization and hashing with DKIM signatures.
+func TestVerifyIndependentSignature(t *testing.T) {
+	const message = "From: Sender <sender@example.org>\r\n" +
+		"Subject:  Folded\r\n\t subject \r\n" +
+		"To: user@example.net\r\n" +
+		"X-Repeated: first\r\n" +
+		"X-Repeated:  second \r\n" +
+		"\r\n" +
+		"Line  with   spaces \r\n" +
+		"\ttabbed\t line\r\n" +
+		"\r\n" +
+		"\r\n"
+	key, _, err := parseDKIMKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupTXT := func(string) ([]string, error) {
+		return []string{"v=DKIM1; k=rsa; p=" + rsaPublicKey}, nil
+	}
+	for _, c := range []struct {
+		header, body dkim.Canonicalization
+	}{
+		{dkim.CanonicalizationSimple, dkim.CanonicalizationSimple},
+		{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed},
+		{dkim.CanonicalizationRelaxed, dkim.CanonicalizationSimple},
+		{dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed},
+	} {
+		var b bytes.Buffer
+		if err := dkim.Sign(&b, strings.NewReader(message), &dkim.SignOptions{
+			Domain:                 "example.org",
+			Selector:               "rsa",
+			Signer:                 key,
+			HeaderCanonicalization: c.header,
+			BodyCanonicalization:   c.body,
+			HeaderKeys:             []string{"From", "Subject", "To", "X-Repeated", "X-Repeated", "X-Repeated", "X-Missing"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		fields, body := parseMessage(b.Bytes())
+		set := &arcSet{}
+		for _, f := range fields {
+			if strings.EqualFold(f.name, "DKIM-Signature") {
+				set.ams = f
+			}
+		}
+		if err := verifyMessageSignature(lookupTXT, set, fields, body); err != nil {
+			t.Fatalf("%s/%s: %s", c.header, c.body, err)
+		}
+	}
+}
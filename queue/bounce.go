@@ -0,0 +1,306 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Record kind used for storing bounces.
+const bounceRecord = "bounces"
+
+// Classification of a bounce.
+type BounceType string
+
+const (
+	// Permanent failure; further mail to the recipient will also fail.
+	HardBounce BounceType = "hard"
+	// Temporary failure, such as a full mailbox.
+	SoftBounce BounceType = "soft"
+)
+
+// Bounce received for a recipient of a message sent from the queue.
+type Bounce struct {
+	MessageID  string     `json:"message_id"`
+	Recipient  string     `json:"recipient"`
+	Type       BounceType `json:"type"`
+	Status     string     `json:"status"`
+	Diagnostic string     `json:"diagnostic"`
+	Time       time.Time  `json:"time"`
+}
+
+var (
+	enhancedStatusRegexp = regexp.MustCompile(`[245]\.\d{1,3}\.\d{1,3}`)
+	replyCodeRegexp      = regexp.MustCompile(`(?m)^\s*([245]\d\d)[ -]`)
+	anyReplyCodeRegexp   = regexp.MustCompile(`\b[45]\d\d\b`)
+
+	// Phrases used by servers that do not include status codes
+	softBouncePhrases = []string{
+		"mailbox full", "mailbox is full", "over quota", "quota exceeded",
+		"temporarily", "try again later",
+	}
+	hardBouncePhrases = []string{
+		"user unknown", "no such user", "does not exist", "unknown user",
+		"mailbox unavailable", "address rejected", "invalid recipient",
+	}
+)
+
+// Report for a single recipient found in a bounce message.
+type bounceReport struct {
+	recipient  string
+	action     string
+	status     string
+	diagnostic string
+}
+
+// Determine whether the report describes a failure. Delivery status
+// notifications may also report recipients for which the message was
+// delivered or relayed successfully. Reports without a status, such as those
+// for automatic replies, are not failures.
+func (b *bounceReport) failed() bool {
+	switch b.action {
+	case "delivered", "relayed", "expanded":
+		return false
+	}
+	return b.status != "" && !strings.HasPrefix(b.status, "2")
+}
+
+// Classify the report as a hard or soft bounce.
+func (b *bounceReport) bounceType() BounceType {
+	if b.action == "delayed" || strings.HasPrefix(b.status, "4") {
+		return SoftBounce
+	}
+	if strings.HasPrefix(b.status, "5") {
+		return HardBounce
+	}
+	return SoftBounce
+}
+
+// Remove the address type prefix from a field such as "rfc822; a@example.com".
+func stripAddressType(v string) string {
+	if i := strings.Index(v, ";"); i != -1 {
+		v = v[i+1:]
+	}
+	return strings.Trim(strings.TrimSpace(v), "<>")
+}
+
+// Parse the per-recipient fields of a message/delivery-status part (RFC 3464).
+func parseDeliveryStatus(r io.Reader) []*bounceReport {
+	var (
+		t       = textproto.NewReader(bufio.NewReader(r))
+		reports []*bounceReport
+	)
+	for {
+		h, err := t.ReadMIMEHeader()
+		if len(h) != 0 {
+			recipient := h.Get("Final-Recipient")
+			if recipient == "" {
+				recipient = h.Get("Original-Recipient")
+			}
+			if recipient != "" {
+				reports = append(reports, &bounceReport{
+					recipient:  stripAddressType(recipient),
+					action:     strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+					status:     strings.TrimSpace(h.Get("Status")),
+					diagnostic: strings.TrimSpace(stripAddressType(h.Get("Diagnostic-Code"))),
+				})
+			}
+		}
+		if err != nil {
+			return reports
+		}
+	}
+}
+
+// Find the first of the phrases contained in the text.
+func findPhrase(text string, phrases []string) string {
+	for _, p := range phrases {
+		if strings.Contains(text, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Determine whether the character is part of a word.
+func isWordChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Find an enhanced status code (RFC 3463) in the text. Codes are only
+// recognized alongside a reply code, and never as part of a longer dotted
+// number such as an IP address.
+func findEnhancedStatus(text string) string {
+	if !anyReplyCodeRegexp.MatchString(text) {
+		return ""
+	}
+	for _, m := range enhancedStatusRegexp.FindAllStringIndex(text, -1) {
+		i, j := m[0], m[1]
+		if i > 0 && (isWordChar(text[i-1]) || text[i-1] == '.') {
+			continue
+		}
+		if j < len(text) && (isWordChar(text[j]) ||
+			(text[j] == '.' && j+1 < len(text) && isWordChar(text[j+1]))) {
+			continue
+		}
+		return text[i:j]
+	}
+	return ""
+}
+
+// Guess the status of a bounce that is not a delivery status notification
+// from the status codes or phrases it contains. Phrases indicating a hard
+// bounce take precedence over those indicating a soft bounce.
+func guessBounceReport(text string) *bounceReport {
+	b := &bounceReport{}
+	if s := findEnhancedStatus(text); s != "" {
+		b.status = s
+	} else if m := replyCodeRegexp.FindStringSubmatch(text); m != nil {
+		b.status = m[1][:1] + ".0.0"
+	} else {
+		lower := strings.ToLower(text)
+		if p := findPhrase(lower, hardBouncePhrases); p != "" {
+			b.status = "5.0.0"
+			b.diagnostic = p
+		} else if p := findPhrase(lower, softBouncePhrases); p != "" {
+			b.status = "4.0.0"
+			b.diagnostic = p
+		}
+	}
+	if b.diagnostic == "" && b.status != "" {
+		for _, l := range strings.Split(text, "\n") {
+			if strings.Contains(l, b.status) || strings.Contains(l, b.status[:1]+"0") {
+				b.diagnostic = strings.TrimSpace(l)
+				break
+			}
+		}
+	}
+	return b
+}
+
+// Decode the body of a part according to its transfer encoding.
+func decodePart(h textproto.MIMEHeader, r io.Reader) io.Reader {
+	if strings.EqualFold(strings.TrimSpace(h.Get("Content-Transfer-Encoding")), "base64") {
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	return r
+}
+
+// Parse a bounce message, returning the reports for each recipient.
+// Delivery status notifications (RFC 3464) are parsed; any other message is
+// examined for status codes and common phrases.
+func parseBounce(message []byte) ([]*bounceReport, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		reports []*bounceReport
+		text    bytes.Buffer
+	)
+	mediaType, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(m.Body, params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err != nil {
+				break
+			}
+			t, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			data, err := ioutil.ReadAll(decodePart(p.Header, p))
+			if err != nil {
+				break
+			}
+			switch t {
+			case "message/delivery-status":
+				reports = append(reports, parseDeliveryStatus(bytes.NewReader(data))...)
+			case "text/plain", "":
+				text.Write(data)
+			}
+		}
+	} else {
+		data, err := ioutil.ReadAll(decodePart(textproto.MIMEHeader(m.Header), m.Body))
+		if err != nil {
+			return nil, err
+		}
+		text.Write(data)
+	}
+	if len(reports) == 0 {
+		reports = append(reports, guessBounceReport(text.String()))
+	}
+	return reports, nil
+}
+
+// Determine whether the address is in the bounce domain.
+func (q *Queue) IsBounceAddress(address string) bool {
+	bounceDomain := q.getConfig().BounceDomain
+	i := strings.LastIndex(address, "@")
+	return bounceDomain != "" && i != -1 && strings.EqualFold(address[i+1:], bounceDomain)
+}
+
+// Process a bounce message sent to the specified addresses in the bounce
+// domain. Each bounce is matched to the message and recipient it refers to
+// using the signed VERP return path; bounces sent to any other address are
+// ignored since they cannot be attributed to a message sent from the queue.
+// Recipients that did not fail are also ignored. The bounces are recorded
+// and returned.
+func (q *Queue) ProcessBounce(to []string, message []byte) ([]*Bounce, error) {
+	reports, err := parseBounce(message)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		config  = q.getConfig()
+		now     = time.Now()
+		bounces []*Bounce
+	)
+	for _, t := range to {
+		id, recipient, ok := ParseVERP(config.BounceDomain, config.BounceSecret, t)
+		if !ok {
+			q.log.Warningf("ignoring bounce for %s", t)
+			continue
+		}
+		report := reports[0]
+		for _, r := range reports {
+			if strings.EqualFold(r.recipient, recipient) {
+				report = r
+				break
+			}
+		}
+		if !report.failed() {
+			continue
+		}
+		bounces = append(bounces, &Bounce{
+			MessageID:  id,
+			Recipient:  recipient,
+			Type:       report.bounceType(),
+			Status:     report.status,
+			Diagnostic: report.diagnostic,
+			Time:       now,
+		})
+	}
+	for _, b := range bounces {
+		q.log.Infof("%s bounce for %s (%s)", b.Type, b.Recipient, b.Status)
+		if err := q.Storage.SaveRecord(bounceRecord, uuid.New(), b); err != nil {
+			return nil, err
+		}
+		if b.Type == HardBounce {
+			if _, err := q.Storage.Suppress(b.Recipient, strings.TrimSpace(fmt.Sprintf("bounce: %s %s", b.Status, b.Diagnostic))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bounces, nil
+}
@@ -0,0 +1,168 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var dsnBounce = strings.Replace(`From: MAILER-DAEMON@mx.example.com
+To: bounces@bounce.example.org
+Subject: Delivery Status Notification (Failure)
+Content-Type: multipart/report; report-type=delivery-status; boundary="b"
+
+--b
+Content-Type: text/plain
+
+Your message could not be delivered.
+
+--b
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.com
+
+Final-Recipient: rfc822; a@example.com
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 User unknown
+
+Final-Recipient: rfc822; b@example.com
+Action: delayed
+Status: 4.2.2
+Diagnostic-Code: smtp; 452 4.2.2 Mailbox full
+
+Final-Recipient: rfc822; c@example.com
+Action: delivered
+Status: 2.0.0
+
+--b
+Content-Type: text/rfc822-headers
+
+From: me@example.org
+Message-Id: <1234@hectane>
+
+--b--
+`, "\n", "\r\n", -1)
+
+func TestParseBounce(t *testing.T) {
+	reports, err := parseBounce([]byte(dsnBounce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("%d != 3", len(reports))
+	}
+	if r := reports[0]; r.recipient != "a@example.com" || r.bounceType() != HardBounce || r.diagnostic != "550 5.1.1 User unknown" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if r := reports[1]; r.recipient != "b@example.com" || r.bounceType() != SoftBounce {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if r := reports[2]; r.recipient != "c@example.com" || r.failed() {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	for text, bounceType := range map[string]BounceType{
+		"<a@example.com>: host mx.example.com said: 550 5.1.1 No such user":   HardBounce,
+		"<a@example.com>:\n552 Requested action aborted":                      HardBounce,
+		"Delivery to the following recipient failed: user unknown":            HardBounce,
+		"The recipient's mailbox is full and can't accept messages right now": SoftBounce,
+		"User unknown; the message will not be retried temporarily":           HardBounce,
+	} {
+		reports, err := parseBounce([]byte("Subject: Undeliverable\r\n\r\n" + text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := reports[0].bounceType(); b != bounceType {
+			t.Fatalf("%q: %s != %s", text, b, bounceType)
+		}
+	}
+	for _, text := range []string{
+		"I am out of the office. My server is at 5.9.12.34.",
+		"I am out of the office until 12.5.1.2024; call extension 550.",
+		"I am out of the office.",
+	} {
+		reports, err := parseBounce([]byte("Subject: Out of office\r\n\r\n" + text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := reports[0]; r.status != "" || r.failed() {
+			t.Fatalf("%q: unexpected report %+v", text, r)
+		}
+	}
+}
+
+func TestProcessBounce(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	q, err := NewQueue(&Config{
+		Directory:    d,
+		BounceDomain: "bounce.example.org",
+		BounceSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	if !q.IsBounceAddress("bounces@BOUNCE.example.org") || q.IsBounceAddress("me@example.org") {
+		t.Fatal("bounce address not recognized")
+	}
+	bounces, err := q.ProcessBounce([]string{
+		VERPAddress("bounce.example.org", "secret", "1234", "a@example.com"),
+		VERPAddress("bounce.example.org", "secret", "5678", "b@example.com"),
+		VERPAddress("bounce.example.org", "secret", "9012", "c@example.com"),
+	}, []byte(dsnBounce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounces) != 2 {
+		t.Fatalf("%d != 2", len(bounces))
+	}
+	if b := bounces[0]; b.MessageID != "1234" || b.Recipient != "a@example.com" || b.Type != HardBounce {
+		t.Fatalf("unexpected bounce %+v", b)
+	}
+	if b := bounces[1]; b.MessageID != "5678" || b.Recipient != "b@example.com" || b.Type != SoftBounce {
+		t.Fatalf("unexpected bounce %+v", b)
+	}
+	bounces, err = q.ProcessBounce([]string{
+		"bounces@bounce.example.org",
+		VERPAddress("bounce.example.org", "forged", "1234", "d@example.com"),
+	}, []byte("Subject: Undeliverable\r\n\r\n550 5.1.1 User unknown\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounces) != 0 {
+		t.Fatalf("%d != 0", len(bounces))
+	}
+	names, err := q.Storage.Records(bounceRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("%d != 2", len(names))
+	}
+	if ok, _ := q.Storage.IsSuppressed("a@example.com"); !ok {
+		t.Fatal("hard bounce should be suppressed")
+	}
+	if ok, _ := q.Storage.IsSuppressed("b@example.com"); ok {
+		t.Fatal("soft bounce should not be suppressed")
+	}
+	if ok, _ := q.Storage.IsSuppressed("d@example.com"); ok {
+		t.Fatal("forged bounce should not be suppressed")
+	}
+	bounces, err = q.ProcessBounce([]string{
+		VERPAddress("bounce.example.org", "secret", "3456", "e@example.com"),
+	}, []byte("Subject: Out of office\r\n\r\nReach me at 5.9.12.34 instead.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounces) != 0 {
+		t.Fatalf("%d != 0", len(bounces))
+	}
+	if ok, _ := q.Storage.IsSuppressed("e@example.com"); ok {
+		t.Fatal("automatic reply should not be suppressed")
+	}
+}
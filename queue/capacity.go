@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// Error indicating that the queue cannot accept any more messages.
+type CapacityError struct {
+	Reason string
+}
+
+func (c *CapacityError) Error() string {
+	return fmt.Sprintf("queue is full: %s", c.Reason)
+}
+
+// Determine the free space available for the specified directory. If the
+// directory does not exist yet, the closest parent that does is used.
+func availableSpace(directory string) (uint64, error) {
+	for {
+		n, err := freeSpace(directory)
+		if err == nil || !os.IsNotExist(err) || path.Dir(directory) == directory {
+			return n, err
+		}
+		directory = path.Dir(directory)
+	}
+}
+
+// Check whether the queue is able to accept new messages. A CapacityError is
+// returned if any of the configured limits have been reached.
+func (q *Queue) CheckCapacity() error {
+	var (
+		c               = q.getConfig()
+		messages, bytes = q.Storage.Usage()
+	)
+	if c.MaxMessages > 0 && messages >= c.MaxMessages {
+		return &CapacityError{
+			Reason: fmt.Sprintf("%d message(s) queued", messages),
+		}
+	}
+	if c.MaxBytes > 0 && bytes >= c.MaxBytes {
+		return &CapacityError{
+			Reason: fmt.Sprintf("%d byte(s) queued", bytes),
+		}
+	}
+	if c.MinFreeBytes > 0 {
+		free, err := availableSpace(c.Directory)
+		if err != nil {
+			return err
+		}
+		if free < uint64(c.MinFreeBytes) {
+			return &CapacityError{
+				Reason: fmt.Sprintf("%d byte(s) of disk space free", free),
+			}
+		}
+	}
+	return nil
+}
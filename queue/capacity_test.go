@@ -0,0 +1,42 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckCapacity(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	q, err := NewQueue(&Config{
+		Directory:   d,
+		MaxMessages: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	if err := q.CheckCapacity(); err != nil {
+		t.Fatal(err)
+	}
+	w, body, err := q.Storage.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Storage.SaveMessage(&Message{}, body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.CheckCapacity().(*CapacityError); !ok {
+		t.Fatal("CapacityError expected")
+	}
+	if !q.Status().Backpressure {
+		t.Fatal("backpressure expected")
+	}
+}
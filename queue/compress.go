@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"github.com/klauspost/compress/zstd"
+
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression formats that may be used for message bodies. The format of each
+// body is recorded by the extension of its filename so that bodies written
+// with a different setting (or before compression was supported) can still be
+// read.
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Filename extensions for each of the compression formats.
+var compressionExtensions = map[string]string{
+	compressionNone: "",
+	compressionGzip: ".gz",
+	compressionZstd: ".zst",
+}
+
+// Determine if the filename is that of a body in any compression format.
+func isBodyFilename(name string) bool {
+	for _, ext := range compressionExtensions {
+		if name == bodyFilename+ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure that the specified compression format is supported.
+func checkCompression(format string) error {
+	if _, ok := compressionExtensions[format]; !ok {
+		return fmt.Errorf("unsupported compression format \"%s\"", format)
+	}
+	return nil
+}
+
+// Writer that compresses data before writing it to an underlying writer.
+// Closing the writer flushes any compressed data and closes the underlying
+// writer.
+type compressWriter struct {
+	io.WriteCloser
+	w io.WriteCloser
+}
+
+// Abandon the compressed data and the underlying writer.
+func (c *compressWriter) discard() {
+	c.WriteCloser.Close()
+	discardWriter(c.w)
+}
+
+// Flush and close the compressor followed by the underlying writer. If the
+// compressor fails, the underlying writer is discarded so that a truncated
+// file is not committed.
+func (c *compressWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		discardWriter(c.w)
+		return err
+	}
+	return c.w.Close()
+}
+
+// Wrap the writer so that data is compressed using the specified format.
+func newCompressWriter(w io.WriteCloser, format string) (io.WriteCloser, error) {
+	switch format {
+	case compressionGzip:
+		return &compressWriter{
+			WriteCloser: gzip.NewWriter(w),
+			w:           w,
+		}, nil
+	case compressionZstd:
+		z, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &compressWriter{
+			WriteCloser: z,
+			w:           w,
+		}, nil
+	default:
+		return w, nil
+	}
+}
+
+// Reader that decompresses data from an underlying reader. Closing the reader
+// also closes the underlying reader.
+type decompressReader struct {
+	io.Reader
+	close func()
+	r     io.ReadCloser
+}
+
+// Release the decompressor and close the underlying reader.
+func (d *decompressReader) Close() error {
+	d.close()
+	return d.r.Close()
+}
+
+// Wrap the reader so that data in the specified format is decompressed.
+func newDecompressReader(r io.ReadCloser, format string) (io.ReadCloser, error) {
+	switch format {
+	case compressionGzip:
+		g, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{
+			Reader: g,
+			close:  func() { g.Close() },
+			r:      r,
+		}, nil
+	case compressionZstd:
+		z, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressReader{
+			Reader: z,
+			close:  z.Close,
+			r:      r,
+		}, nil
+	default:
+		return r, nil
+	}
+}
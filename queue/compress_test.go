@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// File that fails writes once the allowed number of writes have been made,
+// as would happen if the disk were full.
+type failingFile struct {
+	*atomicFile
+	allowed int
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.allowed > 0 {
+		f.allowed--
+		return f.atomicFile.Write(p)
+	}
+	return 0, errors.New("write failed")
+}
+
+func TestCompressWriterDiscard(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	for _, format := range []string{compressionGzip, compressionZstd} {
+		name := path.Join(d, format)
+		f, err := newAtomicFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newCompressWriter(&failingFile{atomicFile: f}, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("data"))
+		if err := w.Close(); err == nil {
+			t.Fatal("error expected")
+		}
+		for _, n := range []string{name, name + tempExtension} {
+			if _, err := os.Stat(n); !os.IsNotExist(err) {
+				t.Fatalf("%s exists", n)
+			}
+		}
+	}
+}
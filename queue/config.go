@@ -1,10 +1,52 @@
 package queue
 
-// See https://github.com/Freeaqingme/dkim
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Configuration for a single DKIM signature.
 type DKIMConfig struct {
 	PrivateKey       string `json:"private-key"`
 	Selector         string `json:"selector"`
 	Canonicalization string `json:"canonicalization"`
+
+	// File containing the PEM-encoded private key, used instead of including
+	// the key in the configuration
+	PrivateKeyFile string `json:"private-key-file"`
+
+	// Signing algorithm ("rsa-sha256" or "ed25519-sha256"), which must match
+	// the private key (determined from the key if empty)
+	Algorithm string `json:"algorithm"`
+
+	// Signing domain when different from the domain of the sender, such as
+	// for a signature on behalf of an email service provider
+	Domain string `json:"domain"`
+
+	// Header fields to sign (a recommended set if empty)
+	Headers []string `json:"headers"`
+
+	// Number of seconds the signature remains valid (zero for no expiry),
+	// which must exceed the time for which delivery is retried since
+	// messages are signed when they are queued
+	Expiration int `json:"expiration"`
+}
+
+// List of DKIM signatures for a domain. A single object is also accepted for
+// compatibility with configurations that predate multiple signatures.
+type DKIMConfigList []DKIMConfig
+
+// Decode either a list of DKIM configs or a single DKIM config.
+func (d *DKIMConfigList) UnmarshalJSON(b []byte) error {
+	var c DKIMConfig
+	if err := json.Unmarshal(b, &c); err == nil {
+		*d = DKIMConfigList{c}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]DKIMConfig)(d))
 }
 
 // Application configuration.
@@ -12,6 +54,111 @@ type Config struct {
 	Directory              string `json:"directory"`
 	DisableSSLVerification bool   `json:"disable-ssl-verification"`
 
-	// Map domain names to DKIM config for that domain
-	DKIMConfigs map[string]DKIMConfig `json:"dkim-configs"`
+	// Compression format for message bodies ("gzip", "zstd" or empty)
+	Compression string `json:"compression"`
+
+	// Keys for encrypting message bodies and metadata, each either a filename
+	// or "env:" followed by the name of an environment variable; the first
+	// key is used for new files and the others are kept for reading
+	EncryptionKeys []string `json:"encryption-keys"`
+
+	// Limits on the number of queued messages, the bytes used by their
+	// bodies and the free disk space that must remain (zero for no limit)
+	MaxMessages  int   `json:"max-messages"`
+	MaxBytes     int64 `json:"max-bytes"`
+	MinFreeBytes int64 `json:"min-free-bytes"`
+
+	// Public IP addresses that mail is sent from, which the check-domain
+	// command checks against the SPF record of each sending domain
+	OutboundIPs []string `json:"outbound-ips"`
+
+	// Domain for VERP return paths; when set, each recipient receives a
+	// separate message whose envelope sender identifies it
+	BounceDomain string `json:"bounce-domain"`
+
+	// Secret for signing VERP return paths so that bounces for messages
+	// that were not sent from the queue are ignored; required for VERP
+	BounceSecret string `json:"bounce-secret"`
+
+	// Initial number of seconds between delivery attempts and the maximum
+	// number of attempts (zero for the defaults)
+	RetryInterval int `json:"retry-interval"`
+	MaxRetries    int `json:"max-retries"`
+
+	// Map domain names to the DKIM signatures for that domain
+	DKIMConfigs map[string]DKIMConfigList `json:"dkim-configs"`
+
+	// Map receiving domains to the ARC sealing config for mail received
+	// for that domain by the SMTP server
+	ARCConfigs map[string]ARCConfig `json:"arc-configs"`
+}
+
+// Determine the initial amount of time between delivery attempts.
+func (c *Config) retryInterval() time.Duration {
+	if c.RetryInterval > 0 {
+		return time.Duration(c.RetryInterval) * time.Second
+	}
+	return time.Minute
+}
+
+// Determine the maximum number of delivery attempts.
+func (c *Config) maxRetries() int {
+	if c.MaxRetries > 0 {
+		return c.MaxRetries
+	}
+	return 18
+}
+
+// Determine the amount of time to wait after the specified number of failed
+// delivery attempts. The delay doubles for the first eight attempts and
+// remains the same after that.
+func (c *Config) retryDelay(tries int) time.Duration {
+	if tries > 8 {
+		tries = 8
+	}
+	return c.retryInterval() << uint(tries)
+}
+
+// Determine the longest amount of time a message can remain in the queue
+// while delivery is retried.
+func (c *Config) retryWindow() time.Duration {
+	var d time.Duration
+	for tries := 1; tries < c.maxRetries(); tries++ {
+		d += c.retryDelay(tries)
+	}
+	return d
+}
+
+// Ensure that the configuration is valid. Encryption keys and DKIM private
+// keys are loaded to ensure that they can be used.
+func (c *Config) Validate() error {
+	if err := checkCompression(c.Compression); err != nil {
+		return err
+	}
+	if _, err := newKeyring(c.EncryptionKeys); err != nil {
+		return err
+	}
+	if c.BounceDomain != "" && c.BounceSecret == "" {
+		return errors.New("a bounce secret is required with a bounce domain")
+	}
+	for _, ip := range c.OutboundIPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid outbound IP address \"%s\"", ip)
+		}
+	}
+	window := c.retryWindow()
+	for domain, l := range c.DKIMConfigs {
+		for _, d := range l {
+			if e := time.Duration(d.Expiration) * time.Second; e > 0 && e <= window {
+				return fmt.Errorf(
+					"DKIM config for %s: expiration must exceed the retry window of %s",
+					domain, window,
+				)
+			}
+		}
+	}
+	if _, err := NewDKIMRegistry(c); err != nil {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,320 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Encrypted files begin with a header consisting of a magic value, the ID of
+// the key used to encrypt them, and a random nonce prefix. The remainder of
+// the file is a sequence of chunks, each sealed separately so that large
+// bodies can be streamed. Every chunk is prefixed with its length, with the
+// high bit set on the final chunk so that truncation can be detected.
+const (
+	encryptionMagic = "\x89HQE"
+	keyIDSize       = 8
+	nonceSize       = 12
+	headerSize      = len(encryptionMagic) + keyIDSize + nonceSize
+	chunkSize       = 64 * 1024
+	finalChunk      = 1 << 31
+)
+
+var (
+	errNoKeys         = errors.New("file is encrypted but no keys are configured")
+	errUnknownKey     = errors.New("file is encrypted with an unknown key")
+	errTruncatedFile  = errors.New("encrypted file is truncated")
+	errTrailingChunks = errors.New("encrypted file has data after the final chunk")
+	errChunkLength    = errors.New("encrypted file has a chunk that is too long")
+)
+
+// Encryption key and its identifier.
+type key struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// Set of keys used for encrypting files. The first key is used for writing
+// new files and all of them are tried when reading files.
+type keyring struct {
+	keys []*key
+}
+
+// Load a key from the specified source. Sources beginning with "env:" name an
+// environment variable and anything else is treated as a filename. Keys must
+// be 16, 24 or 32 bytes long and base64-encoded.
+func loadKey(source string) (*key, error) {
+	var data string
+	if strings.HasPrefix(source, "env:") {
+		name := strings.TrimPrefix(source, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		data = v
+	} else {
+		b, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		data = string(b)
+	}
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("key from %s: %s", source, err)
+	}
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, fmt.Errorf("key from %s: %s", source, err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(k)
+	return &key{
+		id:   h[:keyIDSize],
+		aead: aead,
+	}, nil
+}
+
+// Create a keyring from the specified sources. No keyring is returned if no
+// sources were specified, indicating that encryption is disabled.
+func newKeyring(sources []string) (*keyring, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	k := &keyring{}
+	for _, s := range sources {
+		key, err := loadKey(s)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, key)
+	}
+	return k, nil
+}
+
+// Find the key with the specified ID.
+func (k *keyring) find(id []byte) *key {
+	for _, key := range k.keys {
+		if bytes.Equal(key.id, id) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Determine the nonce for the specified chunk by combining the prefix from
+// the header with the chunk's index.
+func chunkNonce(prefix []byte, index uint64) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], binary.BigEndian.Uint64(nonce[nonceSize-8:])^index)
+	return nonce
+}
+
+// Determine the additional data for a chunk, which binds it to the header and
+// records whether it is the final chunk.
+func chunkAdditionalData(header []byte, final bool) []byte {
+	ad := append([]byte{}, header...)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// Writer that encrypts data in chunks before writing it to an underlying
+// writer. Closing the writer seals the final chunk and closes the underlying
+// writer.
+type encryptWriter struct {
+	w      io.WriteCloser
+	key    *key
+	header []byte
+	buff   []byte
+	index  uint64
+}
+
+// Create a writer that encrypts data using the current key.
+func (k *keyring) newWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	key := k.keys[0]
+	header := make([]byte, headerSize)
+	copy(header, encryptionMagic)
+	copy(header[len(encryptionMagic):], key.id)
+	if _, err := io.ReadFull(rand.Reader, header[headerSize-nonceSize:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		key:    key,
+		header: header,
+		buff:   make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Seal the buffered data and write it as a chunk.
+func (e *encryptWriter) writeChunk(final bool) error {
+	var (
+		nonce  = chunkNonce(e.header[headerSize-nonceSize:], e.index)
+		sealed = e.key.aead.Seal(nil, nonce, e.buff, chunkAdditionalData(e.header, final))
+		length = uint32(len(sealed))
+	)
+	if final {
+		length |= finalChunk
+	}
+	if err := binary.Write(e.w, binary.BigEndian, length); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.buff = e.buff[:0]
+	e.index++
+	return nil
+}
+
+// Buffer the data, writing chunks as they are filled.
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(e.buff) == chunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buff[len(e.buff):chunkSize], p)
+		e.buff = e.buff[:len(e.buff)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Abandon the buffered data and the underlying writer.
+func (e *encryptWriter) discard() {
+	discardWriter(e.w)
+}
+
+// Write the final chunk and close the underlying writer. If the chunk cannot
+// be written, the underlying writer is discarded so that a truncated file is
+// not committed.
+func (e *encryptWriter) Close() error {
+	if err := e.writeChunk(true); err != nil {
+		discardWriter(e.w)
+		return err
+	}
+	return e.w.Close()
+}
+
+// Reader that decrypts chunks from an underlying reader.
+type decryptReader struct {
+	r      *bufio.Reader
+	c      io.Closer
+	key    *key
+	header []byte
+	buff   []byte
+	index  uint64
+	final  bool
+}
+
+// Read and open the next chunk.
+func (d *decryptReader) readChunk() error {
+	var length uint32
+	if err := binary.Read(d.r, binary.BigEndian, &length); err != nil {
+		if err == io.EOF {
+			return errTruncatedFile
+		}
+		return err
+	}
+	final := length&finalChunk != 0
+	// The length has not been authenticated yet and must not be trusted
+	if int(length&^finalChunk) > chunkSize+d.key.aead.Overhead() {
+		return errChunkLength
+	}
+	sealed := make([]byte, length&^finalChunk)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return errTruncatedFile
+	}
+	nonce := chunkNonce(d.header[headerSize-nonceSize:], d.index)
+	b, err := d.key.aead.Open(sealed[:0], nonce, sealed, chunkAdditionalData(d.header, final))
+	if err != nil {
+		return err
+	}
+	d.buff = b
+	d.index++
+	d.final = final
+	return nil
+}
+
+// Decrypt data from the underlying reader.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buff) == 0 {
+		if d.final {
+			if _, err := d.r.ReadByte(); err != io.EOF {
+				return 0, errTrailingChunks
+			}
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buff)
+	d.buff = d.buff[n:]
+	return n, nil
+}
+
+// Close the underlying reader.
+func (d *decryptReader) Close() error {
+	return d.c.Close()
+}
+
+// Wrapper that allows a buffered reader to be closed.
+type bufferedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// Create a reader that decrypts data if it is encrypted. Data without the
+// encryption header is returned unchanged, allowing files written before
+// encryption was enabled to be read. The keyring may be nil.
+func (k *keyring) newReader(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if m, err := br.Peek(len(encryptionMagic)); err != nil || string(m) != encryptionMagic {
+		return &bufferedReadCloser{
+			Reader: br,
+			Closer: r,
+		}, nil
+	}
+	if k == nil {
+		return nil, errNoKeys
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errTruncatedFile
+	}
+	key := k.find(header[len(encryptionMagic) : len(encryptionMagic)+keyIDSize])
+	if key == nil {
+		return nil, errUnknownKey
+	}
+	return &decryptReader{
+		r:      br,
+		c:      r,
+		key:    key,
+		header: header,
+	}, nil
+}
@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Create a file containing a new random key, returning its filename.
+func createKeyFile(d string) (string, error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(d, "")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(base64.StdEncoding.EncodeToString(k))); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	f, err := createKeyFile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := newKeyring([]string{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, chunkSize, chunkSize*2 + 1} {
+		var (
+			data = make([]byte, size)
+			buff = &bytes.Buffer{}
+		)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		w, err := k.newWriter(nopWriteCloser{buff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := buff.Bytes()
+		r, err := k.newReader(ioutil.NopCloser(bytes.NewReader(encrypted)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("data mismatch for size %d", size)
+		}
+		r, err = k.newReader(ioutil.NopCloser(bytes.NewReader(encrypted[:len(encrypted)-1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatal("error expected")
+		}
+	}
+}
+
+func TestEncryptionChunkLength(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	f, err := createKeyFile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := newKeyring([]string{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := &bytes.Buffer{}
+	w, err := k.newWriter(nopWriteCloser{buff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := buff.Bytes()
+	binary.BigEndian.PutUint32(encrypted[headerSize:], finalChunk-1)
+	r, err := k.newReader(ioutil.NopCloser(bytes.NewReader(encrypted)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != errChunkLength {
+		t.Fatalf("%v != %v", err, errChunkLength)
+	}
+}
+
+func TestEncryptWriterDiscard(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	f, err := createKeyFile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := newKeyring([]string{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Join(d, "file")
+	a, err := newAtomicFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the header can be written
+	w, err := k.newWriter(&failingFile{atomicFile: a, allowed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("error expected")
+	}
+	for _, n := range []string{name, name + tempExtension} {
+		if _, err := os.Stat(n); !os.IsNotExist(err) {
+			t.Fatalf("%s exists", n)
+		}
+	}
+}
+
+func TestStorageKeyRotation(t *testing.T) {
+	data := []byte("test")
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var keys []string
+	for i := 0; i < 2; i++ {
+		f, err := createKeyFile(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, f)
+	}
+	c := &Config{
+		Directory: path.Join(d, "queue"),
+	}
+	for i := 0; i <= len(keys); i++ {
+		c.EncryptionKeys = keys[len(keys)-i:]
+		s, err := NewStorageFromConfig(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, body, err := s.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveMessage(&Message{}, body); err != nil {
+			t.Fatal(err)
+		}
+		messages, err := s.LoadMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != i+1 {
+			t.Fatalf("%d != %d", len(messages), i+1)
+		}
+		for _, m := range messages {
+			r, err := s.GetMessageBody(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(b, data) {
+				t.Fatalf("%v != %v", b, data)
+			}
+		}
+	}
+}
+
+// Writer that ignores calls to Close().
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (n nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package queue
+
+import (
+	"syscall"
+)
+
+// Determine the number of bytes available to the current user on the file
+// system containing the specified directory.
+func freeSpace(directory string) (uint64, error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(directory, &s); err != nil {
+		return 0, err
+	}
+	return uint64(s.Bavail) * uint64(s.Bsize), nil
+}
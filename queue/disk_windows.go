@@ -0,0 +1,19 @@
+package queue
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// Determine the number of bytes available to the current user on the volume
+// containing the specified directory.
+func freeSpace(directory string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(directory)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
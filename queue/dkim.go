@@ -1,71 +1,339 @@
 package queue
 
 import (
-	"bytes"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/sirupsen/logrus"
+
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/mail"
 	"strings"
+	"sync"
+	"time"
+)
 
-	"fmt"
-
-	"io/ioutil"
+// Header fields signed when none are configured (RFC 6376, section 5.4.1).
+// List-Unsubscribe-Post must be signed along with List-Unsubscribe for
+// one-click unsubscribe to be honored (RFC 8058, section 4).
+var dkimHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Resent-Date",
+	"Resent-From", "Resent-To", "Resent-Cc", "In-Reply-To", "References",
+	"List-Id", "List-Help", "List-Unsubscribe", "List-Unsubscribe-Post",
+	"List-Subscribe", "List-Post", "List-Owner", "List-Archive", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
 
-	"github.com/Freeaqingme/dkim"
+var (
+	errDKIMKey       = errors.New("private key is not in PEM format")
+	errDKIMKeyType   = errors.New("private key must be RSA or Ed25519")
+	errDKIMAlgorithm = errors.New("algorithm does not match the private key")
+	errDKIMKeySource = errors.New("private key and private key file cannot both be specified")
 )
 
-var dkimInstances = make(map[string]*dkim.DKIM)
+// Signer for a single DKIM signature.
+type dkimSigner struct {
+	options    dkim.SignOptions
+	expiration time.Duration
+}
 
-func dkimFor(from string, config *Config) (*dkim.DKIM, error) {
-	emailAddress, err := mail.ParseAddress(from)
+// Parse a PEM-encoded RSA or Ed25519 private key, returning the key and the
+// name of its algorithm.
+func parseDKIMKey(data string) (crypto.Signer, string, error) {
+	b, _ := pem.Decode([]byte(data))
+	if b == nil {
+		return nil, "", errDKIMKey
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+		return k, "rsa", nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		return k, "rsa", nil
+	case ed25519.PrivateKey:
+		return k, "ed25519", nil
+	default:
+		return nil, "", errDKIMKeyType
+	}
+}
+
+// Parse a canonicalization setting such as "relaxed/simple". If only one
+// algorithm is specified, it applies to the header and the body uses
+// "simple" (RFC 6376, section 3.5).
+func parseCanonicalization(c string) (dkim.Canonicalization, dkim.Canonicalization) {
+	if c == "" {
+		return dkim.CanonicalizationSimple, dkim.CanonicalizationSimple
+	}
+	parts := strings.SplitN(c, "/", 2)
+	if len(parts) == 1 {
+		return dkim.Canonicalization(parts[0]), dkim.CanonicalizationSimple
+	}
+	return dkim.Canonicalization(parts[0]), dkim.Canonicalization(parts[1])
+}
+
+// Retrieve the PEM-encoded private key, reading it from a file if necessary.
+func (c *DKIMConfig) privateKey() (string, error) {
+	if c.PrivateKeyFile == "" {
+		return c.PrivateKey, nil
+	}
+	if c.PrivateKey != "" {
+		return "", errDKIMKeySource
+	}
+	b, err := ioutil.ReadFile(c.PrivateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Retrieve the public key corresponding to the configured private key.
+func (c *DKIMConfig) PublicKey() (crypto.PublicKey, error) {
+	data, err := c.privateKey()
 	if err != nil {
 		return nil, err
 	}
-	domain := strings.Split(emailAddress.Address, "@")[1]
-	dkimInstance, found := dkimInstances[domain]
-	if found {
-		return dkimInstance, nil
+	key, _, err := parseDKIMKey(data)
+	if err != nil {
+		return nil, err
 	}
-	if config.DKIMConfigs == nil {
-		dkimInstances[domain] = nil
-		return nil, nil
+	return key.Public(), nil
+}
+
+// Create a signer for the specified domain from a DKIM config.
+func newDKIMSigner(domain string, c *DKIMConfig) (*dkimSigner, error) {
+	data, err := c.privateKey()
+	if err != nil {
+		return nil, err
 	}
-	dkimConfig, found := config.DKIMConfigs[domain]
-	if !found {
-		dkimInstances[domain] = nil
-		return nil, nil
+	key, algo, err := parseDKIMKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if c.Algorithm != "" && c.Algorithm != algo+"-sha256" {
+		return nil, errDKIMAlgorithm
+	}
+	if c.Domain != "" {
+		domain = c.Domain
+	}
+	headers := c.Headers
+	if len(headers) == 0 {
+		headers = dkimHeaders
 	}
-	conf, err := dkim.NewConf(domain, dkimConfig.Selector)
+	s := &dkimSigner{
+		options: dkim.SignOptions{
+			Domain:     domain,
+			Selector:   c.Selector,
+			Signer:     key,
+			HeaderKeys: headers,
+			QueryMethods: []dkim.QueryMethod{
+				dkim.QueryMethodDNSTXT,
+			},
+		},
+		expiration: time.Duration(c.Expiration) * time.Second,
+	}
+	s.options.HeaderCanonicalization, s.options.BodyCanonicalization =
+		parseCanonicalization(c.Canonicalization)
+	// Creating a dkim.Signer checks the options; it must be closed to stop
+	// the goroutine waiting for the message
+	signer, err := s.newSigner()
 	if err != nil {
-		dkimInstances[domain] = nil
 		return nil, err
 	}
-	if dkimConfig.Canonicalization != "" {
-		conf[dkim.CanonicalizationKey] = dkimConfig.Canonicalization
+	signer.Close()
+	return s, nil
+}
+
+// Create a dkim.Signer for a new signature.
+func (s *dkimSigner) newSigner() (*dkim.Signer, error) {
+	options := s.options
+	if s.expiration > 0 {
+		options.Expiration = time.Now().Add(s.expiration)
+	}
+	return dkim.NewSigner(&options)
+}
+
+// Registry of DKIM signers for each domain. The signers are created when the
+// registry is loaded so that problems with keys are found immediately rather
+// than when mail is sent. Loading again picks up rotated keys.
+type DKIMRegistry struct {
+	m         sync.RWMutex
+	signers   map[string][]*dkimSigner
+	sealers   map[string]*arcSealer
+	unsigned  map[string]bool
+	lookupTXT func(string) ([]string, error)
+	log       *logrus.Entry
+}
+
+// Create a registry containing the signers in the specified configuration.
+func NewDKIMRegistry(c *Config) (*DKIMRegistry, error) {
+	r := &DKIMRegistry{
+		lookupTXT: net.LookupTXT,
+		log:       logrus.WithField("context", "DKIM"),
+	}
+	if err := r.Load(c); err != nil {
+		return nil, err
 	}
-	// dkim.StdSignableHeaders = []string{"From", "To", "Subject", "From"}
-	dkimInstance, err = dkim.New(conf, []byte(dkimConfig.PrivateKey))
+	return r, nil
+}
 
-	dkimInstances[domain] = dkimInstance
-	return dkimInstance, nil
+// Create the signers and ARC sealers in the specified configuration, reading
+// key files again. A function is returned that replaces the existing signers
+// and sealers, which is only done if all of the keys can be loaded.
+func (r *DKIMRegistry) prepare(c *Config) (func(), error) {
+	signers := make(map[string][]*dkimSigner)
+	for domain, l := range c.DKIMConfigs {
+		for i := range l {
+			s, err := newDKIMSigner(domain, &l[i])
+			if err != nil {
+				return nil, fmt.Errorf("DKIM config for %s: %s", domain, err)
+			}
+			key := strings.ToLower(domain)
+			signers[key] = append(signers[key], s)
+		}
+	}
+	sealers := make(map[string]*arcSealer)
+	for domain, a := range c.ARCConfigs {
+		s, err := newARCSealer(domain, &a)
+		if err != nil {
+			return nil, fmt.Errorf("ARC config for %s: %s", domain, err)
+		}
+		sealers[strings.ToLower(domain)] = s
+	}
+	return func() {
+		r.m.Lock()
+		defer r.m.Unlock()
+		r.signers = signers
+		r.sealers = sealers
+		r.unsigned = make(map[string]bool)
+		r.log.Debugf("loaded DKIM keys for %d domain(s)", len(signers))
+	}, nil
 }
 
-func dkimSigned(from string, input io.ReadCloser, config *Config) (io.ReadCloser, error) {
-	dkim, err := dkimFor(from, config)
+// Replace the signers and ARC sealers with those in the specified
+// configuration.
+func (r *DKIMRegistry) Load(c *Config) error {
+	apply, err := r.prepare(c)
 	if err != nil {
-		return nil, fmt.Errorf("error while getting dkimInstances for %q: %s", from, err)
+		return err
 	}
-	if dkim == nil {
-		return input, nil
+	apply()
+	return nil
+}
+
+// Retrieve the signers for the domain of the specified sender, which is
+// matched without regard to case. The first time that a domain without
+// signers is encountered, a warning is logged. Messages with a null sender
+// are never signed.
+func (r *DKIMRegistry) signersFor(from string) ([]*dkimSigner, error) {
+	if from == "" {
+		return nil, nil
 	}
-	// TODO: Do not load the content
-	defer input.Close()
-	email, err := ioutil.ReadAll(input)
+	emailAddress, err := mail.ParseAddress(from)
 	if err != nil {
-		return nil, fmt.Errorf("error while ReadAll: %s", err)
+		return nil, err
 	}
-	signedEmail, err := dkim.Sign(email)
+	domain := strings.ToLower(strings.Split(emailAddress.Address, "@")[1])
+	r.m.RLock()
+	signers, empty := r.signers[domain], len(r.signers) == 0
+	logged := r.unsigned[domain]
+	r.m.RUnlock()
+	if len(signers) == 0 && !empty && !logged {
+		r.m.Lock()
+		r.unsigned[domain] = true
+		r.m.Unlock()
+		r.log.Warningf("no DKIM keys for %s, sending unsigned", domain)
+	}
+	return signers, nil
+}
+
+// Writer that computes DKIM signatures for a message as it is written.
+type dkimWriter struct {
+	io.Writer
+	signers []*dkim.Signer
+}
+
+// Create a writer that computes each of the signatures configured for the
+// sender's domain. If the domain has no signers, nil is returned. A nil
+// registry also returns nil.
+func (r *DKIMRegistry) newWriter(from string) (*dkimWriter, error) {
+	if r == nil {
+		return nil, nil
+	}
+	signers, err := r.signersFor(from)
 	if err != nil {
-		return nil, fmt.Errorf("error while signing the email: %s", err)
+		return nil, fmt.Errorf("error while getting DKIM signers for %q: %s", from, err)
+	}
+	if len(signers) == 0 {
+		return nil, nil
+	}
+	var (
+		d       = &dkimWriter{}
+		writers []io.Writer
+	)
+	for _, s := range signers {
+		signer, err := s.newSigner()
+		if err != nil {
+			d.abort()
+			return nil, err
+		}
+		d.signers = append(d.signers, signer)
+		writers = append(writers, signer)
+	}
+	d.Writer = io.MultiWriter(writers...)
+	return d, nil
+}
+
+// Stop computing the signatures.
+func (d *dkimWriter) abort() {
+	for _, s := range d.signers {
+		s.Close()
+	}
+}
+
+// Finish computing the signatures, returning the DKIM-Signature header fields
+// in the order that the signatures are configured.
+func (d *dkimWriter) signatures() (string, error) {
+	var (
+		headers  string
+		firstErr error
+	)
+	for _, s := range d.signers {
+		if err := s.Close(); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error while signing the email: %s", err)
+			}
+			continue
+		}
+		headers += s.Signature()
+	}
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return headers, nil
+}
+
+// Compute the signatures for a message from the specified sender, returning
+// the DKIM-Signature header fields to prepend to the message. If the domain
+// has no signers, an empty string is returned.
+func (r *DKIMRegistry) Sign(from string, message io.Reader) (string, error) {
+	d, err := r.newWriter(from)
+	if err != nil || d == nil {
+		return "", err
+	}
+	if _, err := io.Copy(d, message); err != nil {
+		d.abort()
+		return "", err
 	}
-	return ioutil.NopCloser(bytes.NewReader(signedEmail)), nil
+	return d.signatures()
 }
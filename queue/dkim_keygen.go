@@ -0,0 +1,85 @@
+package queue
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Maximum length of a single string within a TXT record.
+const txtStringLength = 255
+
+var errDKIMKeyAlgorithm = errors.New("algorithm must be rsa or ed25519")
+
+// Generate a DKIM private key using the specified algorithm ("rsa" or
+// "ed25519"). The number of bits is only used for RSA keys. The PEM-encoded
+// private key is returned along with the value of the TXT record to publish.
+func GenerateDKIMKey(algo string, bits int) (string, string, error) {
+	var (
+		block  *pem.Block
+		public []byte
+	)
+	switch algo {
+	case "rsa":
+		if bits < 1024 {
+			return "", "", errors.New("RSA keys must be at least 1024 bits")
+		}
+		k, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return "", "", err
+		}
+		public, err = x509.MarshalPKIXPublicKey(&k.PublicKey)
+		if err != nil {
+			return "", "", err
+		}
+		block = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}
+	case "ed25519":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		b, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return "", "", err
+		}
+		public = pub
+		block = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: b,
+		}
+	default:
+		return "", "", errDKIMKeyAlgorithm
+	}
+	record := fmt.Sprintf(
+		"v=DKIM1; k=%s; p=%s",
+		algo,
+		base64.StdEncoding.EncodeToString(public),
+	)
+	return string(pem.EncodeToMemory(block)), record, nil
+}
+
+// Format a TXT record for the specified selector and domain in zone file
+// syntax. Values longer than a single TXT string are split into several.
+func DKIMRecord(selector, domain, value string) string {
+	var parts []string
+	for len(value) > txtStringLength {
+		parts = append(parts, value[:txtStringLength])
+		value = value[txtStringLength:]
+	}
+	parts = append(parts, value)
+	return fmt.Sprintf(
+		"%s._domainkey.%s. IN TXT \"%s\"",
+		selector,
+		domain,
+		strings.Join(parts, "\" \""),
+	)
+}
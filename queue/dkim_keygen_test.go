@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"github.com/emersion/go-msgauth/dkim"
+
+	"strings"
+	"testing"
+)
+
+func TestGenerateDKIMKey(t *testing.T) {
+	for _, algo := range []string{"rsa", "ed25519"} {
+		key, record, err := GenerateDKIMKey(algo, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{
+			DKIMConfigs: map[string]DKIMConfigList{
+				"example.org": {
+					{
+						PrivateKey: key,
+						Selector:   "test",
+						Algorithm:  algo + "-sha256",
+					},
+				},
+			},
+		}
+		r, err := NewDKIMRegistry(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers, err := r.Sign(sampleFrom, strings.NewReader(sampleMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifications, err := dkim.VerifyWithOptions(
+			strings.NewReader(headers+sampleMessage),
+			&dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					return []string{record}, nil
+				},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifications) != 1 {
+			t.Fatalf("%d != 1", len(verifications))
+		}
+		if err := verifications[0].Err; err != nil {
+			t.Fatalf("%s: %s", algo, err)
+		}
+	}
+	if _, _, err := GenerateDKIMKey("dsa", 1024); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestDKIMRecord(t *testing.T) {
+	value := strings.Repeat("a", txtStringLength+1)
+	r := DKIMRecord("s1", "example.org", value)
+	expected := `s1._domainkey.example.org. IN TXT "` + value[:txtStringLength] + `" "a"`
+	if r != expected {
+		t.Fatalf("%s != %s", r, expected)
+	}
+}
@@ -1,15 +1,24 @@
 package queue
 
 import (
+	"github.com/emersion/go-msgauth/dkim"
+
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
-	"testing"
-
+	"os"
+	"path/filepath"
 	"strings"
-
-	"github.com/Freeaqingme/dkim"
+	"sync"
+	"testing"
 )
 
 const (
@@ -74,9 +83,38 @@ eAYXunajbBSOLlx4D+TunwJBANkPI5S9iylsbLs6NkaMHV6k5ioHBBmgCak95JGX
 GMot/L2x0IYyMLAz6oLWh2hm7zwtb0CgOrPo1ke44hFYnfc=
 -----END RSA PRIVATE KEY-----`
 
-	expectedDKIMHeaderPrefix = `v=1; a=rsa-sha256; c=relaxed/simple; d=example.org; q=dns/txt; s=test;`
+	rsaPublicKey = "MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDwIRP/UC3SBsEmGqZ9ZJW3/DkMoGeLnQg1fWn7/zYtIxN2SnFCjxOCKG9v3b4jYfcTNh5ijSsq631uBItLa7od+v/RtdC2UzJ1lWT947qR+Rcac2gbto/NMqJ0fzfVjH4OuKhitdY9tf6mcwGjaNBcWToIMmPSPDdQPNUYckcQ2QIDAQAB"
 )
 
+// Parse the tags in a DKIM-Signature header field value.
+func dkimTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(value, ";") {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) == 2 {
+			tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+		}
+	}
+	return tags
+}
+
+// Generate an Ed25519 private key in PEM format, returning it along with the
+// public key.
+func generateEd25519Key() (string, ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: b,
+	})), pub, nil
+}
+
 // borrowed from
 // https://github.com/kalloc/dkim/blob/acfed5d65dd1e8cebcac4b4d429efa30e4cdedae/dkim.go#L235
 func findDkimHeader(r *bufio.Reader) (string, error) {
@@ -117,19 +155,38 @@ func findDkimHeader(r *bufio.Reader) (string, error) {
 	return value, nil
 }
 
+// Sign a message from sampleFrom using a registry created from the config,
+// returning the message with the signatures prepended.
+func dkimSigned(r io.Reader, config *Config) (io.Reader, error) {
+	d, err := NewDKIMRegistry(config)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := d.Sign(sampleFrom, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(strings.NewReader(headers), bytes.NewReader(b)), nil
+}
+
 func TestDKIMSigning(t *testing.T) {
-	dkimInstances = make(map[string]*dkim.DKIM)
 	config := Config{
-		DKIMConfigs: make(map[string]DKIMConfig),
+		DKIMConfigs: make(map[string]DKIMConfigList),
 	}
-	config.DKIMConfigs["example.org"] = DKIMConfig{
-		PrivateKey:       privKey,
-		Selector:         "test",
-		Canonicalization: "relaxed/simple",
+	config.DKIMConfigs["example.org"] = DKIMConfigList{
+		{
+			PrivateKey:       privKey,
+			Selector:         "test",
+			Canonicalization: "relaxed/simple",
+		},
 	}
 
-	r := ioutil.NopCloser(bytes.NewBufferString(sampleMessage))
-	signedEmail, err := dkimSigned(sampleFrom, r, &config)
+	r := strings.NewReader(sampleMessage)
+	signedEmail, err := dkimSigned(r, &config)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -138,20 +195,157 @@ func TestDKIMSigning(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.HasPrefix(header, expectedDKIMHeaderPrefix) {
-		t.Logf("DKIM header: %s", header)
-		t.Fatalf("The value for DKIM header was not expected")
+	expected := map[string]string{
+		"v": "1",
+		"a": "rsa-sha256",
+		"c": "relaxed/simple",
+		"d": "example.org",
+		"q": "dns/txt",
+		"s": "test",
+	}
+	tags := dkimTags(header)
+	for k, v := range expected {
+		if tags[k] != v {
+			t.Logf("DKIM header: %s", header)
+			t.Fatalf("%s != %s", tags[k], v)
+		}
+	}
+	h := strings.Split(strings.ToLower(tags["h"]), ":")
+	for _, name := range []string{"list-unsubscribe", "list-unsubscribe-post"} {
+		found := false
+		for _, v := range h {
+			if strings.TrimSpace(v) == name {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("%s missing from h=%s", name, tags["h"])
+		}
+	}
+}
+
+func TestDKIMMultipleSignatures(t *testing.T) {
+	edKey, edPub, err := generateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		DKIMConfigs: map[string]DKIMConfigList{
+			"example.org": {
+				{
+					PrivateKey: privKey,
+					Selector:   "rsa",
+					Algorithm:  "rsa-sha256",
+				},
+				{
+					PrivateKey: edKey,
+					Selector:   "ed",
+					Algorithm:  "ed25519-sha256",
+					Expiration: 72 * 3600,
+				},
+				{
+					PrivateKey: privKey,
+					Selector:   "esp",
+					Domain:     "esp.example.com",
+					Headers:    []string{"From", "Subject"},
+				},
+			},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := strings.NewReader(sampleMessage)
+	signedEmail, err := dkimSigned(r, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]string{
+		"rsa._domainkey.example.org":     "v=DKIM1; k=rsa; p=" + rsaPublicKey,
+		"ed._domainkey.example.org":      "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+		"esp._domainkey.esp.example.com": "v=DKIM1; k=rsa; p=" + rsaPublicKey,
+	}
+	verifications, err := dkim.VerifyWithOptions(signedEmail, &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return []string{records[domain]}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 3 {
+		t.Fatalf("%d != 3", len(verifications))
+	}
+	for _, v := range verifications {
+		if v.Err != nil {
+			t.Fatalf("%s: %s", v.Domain, v.Err)
+		}
+	}
+	if verifications[1].Expiration.IsZero() {
+		t.Fatal("expiration expected")
+	}
+}
+
+func TestDKIMInvalidAlgorithm(t *testing.T) {
+	config := Config{
+		DKIMConfigs: map[string]DKIMConfigList{
+			"example.org": {
+				{
+					PrivateKey: privKey,
+					Selector:   "test",
+					Algorithm:  "ed25519-sha256",
+				},
+			},
+		},
+	}
+	if err := config.Validate(); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestDKIMExpiration(t *testing.T) {
+	config := Config{
+		DKIMConfigs: map[string]DKIMConfigList{
+			"example.org": {
+				{
+					PrivateKey: privKey,
+					Selector:   "test",
+					Expiration: 3600,
+				},
+			},
+		},
+	}
+	if err := config.Validate(); err == nil {
+		t.Fatal("error expected")
+	}
+	config.RetryInterval = 60
+	config.MaxRetries = 2
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDKIMConfigList(t *testing.T) {
+	var c Config
+	if err := json.Unmarshal([]byte(`{"dkim-configs": {
+		"example.org": {"selector": "a"},
+		"example.com": [{"selector": "b"}, {"selector": "c"}]
+	}}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(c.DKIMConfigs["example.org"]); l != 1 {
+		t.Fatalf("%d != 1", l)
+	}
+	if l := len(c.DKIMConfigs["example.com"]); l != 2 {
+		t.Fatalf("%d != 2", l)
 	}
 }
 
 func TestDKIMNotSigning(t *testing.T) {
-	dkimInstances = make(map[string]*dkim.DKIM)
 	config := Config{}
-	r := ioutil.NopCloser(bytes.NewBufferString(sampleMessage))
-	signedEmail, err := dkimSigned(sampleFrom, r, &config)
+	r := strings.NewReader(sampleMessage)
+	signedEmail, err := dkimSigned(r, &config)
 	if err != nil {
-		dkim, err2 := dkimFor(sampleFrom, &config)
-		t.Logf("dkim: %v / err2: %s", dkim, err2)
 		t.Fatal(err)
 	}
 	signedEmailContent, err := ioutil.ReadAll(signedEmail)
@@ -162,3 +356,93 @@ func TestDKIMNotSigning(t *testing.T) {
 		t.Fatal("Expecting the message to be untouched")
 	}
 }
+
+func TestDKIMDomainCase(t *testing.T) {
+	r, err := NewDKIMRegistry(&Config{
+		DKIMConfigs: map[string]DKIMConfigList{
+			"Example.ORG": {{PrivateKey: privKey, Selector: "test"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers, err := r.signersFor("User <User@EXAMPLE.org>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 {
+		t.Fatalf("%d != 1", len(signers))
+	}
+}
+
+func TestDKIMRegistryKeyFile(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		f      = filepath.Join(d, "dkim.pem")
+		config = Config{
+			DKIMConfigs: map[string]DKIMConfigList{
+				"example.org": {
+					{
+						PrivateKeyFile: f,
+						Selector:       "test",
+					},
+				},
+			},
+		}
+	)
+	if _, err := NewDKIMRegistry(&config); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := ioutil.WriteFile(f, []byte(privKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewDKIMRegistry(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := generateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f, []byte(edKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Sign(sampleFrom, strings.NewReader(sampleMessage)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	if err := r.Load(&config); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	headers, err := r.Sign(sampleFrom, strings.NewReader(sampleMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := findDkimHeader(bufio.NewReader(strings.NewReader(headers + sampleMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := dkimTags(header)["a"]; a != "ed25519-sha256" {
+		t.Fatalf("%s != ed25519-sha256", a)
+	}
+	if err := ioutil.WriteFile(f, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Load(&config); err == nil {
+		t.Fatal("error expected")
+	}
+	if signers, _ := r.signersFor(sampleFrom); len(signers) != 1 {
+		t.Fatalf("%d != 1", len(signers))
+	}
+}
@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const tempExtension = ".tmp"
+
+// File that is written to a temporary location and only moved into place once
+// its contents have been flushed to disk. This ensures that a crash during the
+// write never leaves a truncated file behind under the final name.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+// Create a new file that will be moved to the specified name when closed.
+// Each writer has its own temporary file, so concurrent writers of the same
+// name never see each other's data; the last one to close wins.
+func newAtomicFile(name string) (*atomicFile, error) {
+	f, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".*"+tempExtension)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{
+		File: f,
+		name: name,
+	}, nil
+}
+
+// Close and remove the temporary file without moving it into place.
+func (a *atomicFile) discard() {
+	a.File.Close()
+	os.Remove(a.File.Name())
+}
+
+// Writer that can be abandoned without committing the data written to it.
+type discarder interface {
+	discard()
+}
+
+// Abandon the writer after an error. Writers that commit their data when
+// closed are discarded instead; any other writer is simply closed.
+func discardWriter(w io.Closer) {
+	if d, ok := w.(discarder); ok {
+		d.discard()
+	} else {
+		w.Close()
+	}
+}
+
+// Flush the file to disk, move it to its final location and sync the
+// directory so that the rename itself survives a crash.
+func (a *atomicFile) Close() error {
+	if err := a.File.Sync(); err != nil {
+		a.discard()
+		return err
+	}
+	if err := a.File.Close(); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	if err := os.Rename(a.File.Name(), a.name); err != nil {
+		os.Remove(a.File.Name())
+		return err
+	}
+	return syncDir(path.Dir(a.name))
+}
@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAtomicFileConcurrent(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	var (
+		name    = path.Join(d, "file")
+		writers = 50
+		wg      sync.WaitGroup
+		errs    = make(chan error, writers)
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := newAtomicFile(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			data := bytes.Repeat([]byte{byte('a' + i%26)}, 4096)
+			for j := 0; j < 4; j++ {
+				if _, err := f.Write(data); err != nil {
+					f.discard()
+					errs <- err
+					return
+				}
+			}
+			errs <- f.Close()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 4*4096 || !bytes.Equal(b, bytes.Repeat(b[:1], len(b))) {
+		t.Fatal("file contains data from more than one writer")
+	}
+	files, err := ioutil.ReadDir(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), tempExtension) {
+			t.Fatalf("temporary file %s left behind", f.Name())
+		}
+	}
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package queue
+
+import (
+	"os"
+)
+
+// Flush the directory entries of the specified directory to disk.
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,7 @@
+package queue
+
+// Directories cannot be opened for syncing on Windows and NTFS journals
+// renames, so no additional work is required.
+func syncDir(name string) error {
+	return nil
+}
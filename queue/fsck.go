@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const quarantineDirectory = "quarantine"
+
+// Names in the storage directory that do not contain message bodies and must
+// be skipped when checking the directory.
+var reservedNames = map[string]bool{
+	quarantineDirectory: true,
+	recordsDirectory:    true,
+	uploadsDirectory:    true,
+	partsDirectory:      true,
+}
+
+// Kind of problem found when checking the storage directory.
+type ProblemType int
+
+const (
+	// Body with no messages referencing it.
+	OrphanBody ProblemType = iota
+	// Directory containing messages whose body does not exist.
+	MissingBody
+	// Message file that could not be decoded.
+	CorruptMessage
+	// Temporary file or directory left behind by an interrupted write.
+	StaleTempFile
+)
+
+// Problem found when checking the storage directory. The path is relative to
+// the storage directory and refers to either a body directory or a single
+// file within one.
+type Problem struct {
+	Type ProblemType
+	Path string
+}
+
+// Describe the problem in a human-readable way.
+func (p *Problem) String() string {
+	switch p.Type {
+	case OrphanBody:
+		return fmt.Sprintf("%s: body has no messages", p.Path)
+	case MissingBody:
+		return fmt.Sprintf("%s: messages have no body", p.Path)
+	case CorruptMessage:
+		return fmt.Sprintf("%s: message is corrupt", p.Path)
+	case StaleTempFile:
+		return fmt.Sprintf("%s: stale temporary file", p.Path)
+	default:
+		return fmt.Sprintf("%s: unknown problem", p.Path)
+	}
+}
+
+// Check the files in a single body directory. A problem with the directory as
+// a whole is reported on its own since fixing it also takes care of any
+// problems with the files it contains. A body whose messages are all corrupt
+// is not an orphan; the corrupt messages are reported instead and the body is
+// found to be an orphan when the directory is checked again.
+func (s *Storage) checkBody(body string) ([]*Problem, error) {
+	files, err := ioutil.ReadDir(s.bodyDirectory(body))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		problems    []*Problem
+		hasBody     bool
+		hasMessages bool
+	)
+	for _, f := range files {
+		p := path.Join(body, f.Name())
+		switch {
+		case isBodyFilename(f.Name()):
+			hasBody = true
+		case strings.HasSuffix(f.Name(), tempExtension):
+			problems = append(problems, &Problem{Type: StaleTempFile, Path: p})
+		case strings.HasSuffix(f.Name(), messageExtension):
+			hasMessages = true
+			// Files that cannot be decrypted with the configured keys are
+			// not corrupt and must not be removed
+			r, err := s.openFile(path.Join(s.directory, p))
+			if err == errNoKeys || err == errUnknownKey {
+				return nil, fmt.Errorf("%s: %s", p, err)
+			}
+			if err == nil {
+				err = json.NewDecoder(r).Decode(&Message{})
+				r.Close()
+			}
+			if err != nil {
+				problems = append(problems, &Problem{Type: CorruptMessage, Path: p})
+			}
+		}
+	}
+	switch {
+	case !hasBody && !hasMessages:
+		return []*Problem{{Type: StaleTempFile, Path: body}}, nil
+	case !hasBody && hasMessages:
+		return []*Problem{{Type: MissingBody, Path: body}}, nil
+	case hasBody && !hasMessages:
+		return []*Problem{{Type: OrphanBody, Path: body}}, nil
+	}
+	return problems, nil
+}
+
+// Check the storage directory for problems. This should not be run while the
+// directory is in use by a queue since messages being written would appear to
+// be incomplete.
+func (s *Storage) Check() ([]*Problem, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	directories, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return []*Problem{}, nil
+	}
+	problems := []*Problem{}
+	for _, d := range directories {
+		if !d.IsDir() || reservedNames[d.Name()] {
+			continue
+		}
+		p, err := s.checkBody(d.Name())
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, p...)
+	}
+	return problems, nil
+}
+
+// Fix the problem by removing the affected file or directory.
+func (s *Storage) Repair(p *Problem) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return os.RemoveAll(path.Join(s.directory, p.Path))
+}
+
+// Fix the problem by moving the affected file or directory to the quarantine
+// directory, where it is preserved for later inspection.
+func (s *Storage) Quarantine(p *Problem) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	dest := path.Join(s.directory, quarantineDirectory, p.Path)
+	if err := os.MkdirAll(path.Dir(dest), 0700); err != nil {
+		return err
+	}
+	return os.Rename(path.Join(s.directory, p.Path), dest)
+}
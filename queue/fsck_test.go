@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Create a storage directory containing one of each type of problem along
+// with a healthy message.
+func createDamagedStorage() (*Storage, error) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		return nil, err
+	}
+	s := NewStorage(d)
+	for i := 0; i < 4; i++ {
+		w, body, err := s.NewBody()
+		if err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		switch i {
+		case 0:
+			// Healthy message
+			if err := s.SaveMessage(&Message{}, body); err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(path.Join(d, body, "x"+tempExtension), nil, 0600); err != nil {
+				return nil, err
+			}
+		case 1:
+			// Orphaned body
+		case 2:
+			// Missing body
+			if err := s.SaveMessage(&Message{}, body); err != nil {
+				return nil, err
+			}
+			if err := os.Remove(s.bodyFilename(body, compressionNone)); err != nil {
+				return nil, err
+			}
+		case 3:
+			// Corrupt message
+			if err := s.SaveMessage(&Message{}, body); err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(path.Join(d, body, "x"+messageExtension), []byte("{"), 0600); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func TestCheck(t *testing.T) {
+	s, err := createDamagedStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(s.directory)
+	problems, err := s.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[ProblemType]bool{}
+	for _, p := range problems {
+		found[p.Type] = true
+	}
+	for _, pt := range []ProblemType{OrphanBody, MissingBody, CorruptMessage, StaleTempFile} {
+		if !found[pt] {
+			t.Fatalf("problem %d not found", pt)
+		}
+	}
+	if len(problems) != 4 {
+		t.Fatalf("%d != 4", len(problems))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	for _, quarantine := range []bool{false, true} {
+		s, err := createDamagedStorage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(s.directory)
+		problems, err := s.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range problems {
+			if quarantine {
+				err = s.Quarantine(p)
+			} else {
+				err = s.Repair(p)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if problems, err = s.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != 0 {
+			t.Fatalf("%d != 0", len(problems))
+		}
+		messages, err := s.LoadMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 {
+			t.Fatalf("%d != 2", len(messages))
+		}
+	}
+}
+
+func TestCheckAllCorrupt(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(d, body, "x"+messageExtension), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := s.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 {
+		t.Fatalf("%d != 1", len(problems))
+	}
+	if problems[0].Type != CorruptMessage {
+		t.Fatalf("%d != %d", problems[0].Type, CorruptMessage)
+	}
+	if err := s.Repair(problems[0]); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err = s.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 {
+		t.Fatalf("%d != 1", len(problems))
+	}
+	if problems[0].Type != OrphanBody {
+		t.Fatalf("%d != %d", problems[0].Type, OrphanBody)
+	}
+}
@@ -36,6 +36,13 @@ type Host struct {
 	stop         chan bool
 }
 
+// Retrieve the current configuration.
+func (h *Host) getConfig() *Config {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.config
+}
+
 // Receive the next message in the queue. The host queue is considered
 // "inactive" while waiting for new messages to arrive. The current time is
 // recorded before entering the select{} block so that the Idle() method can
@@ -94,7 +101,7 @@ func (h *Host) tryMailServer(server, hostname string) (*smtp.Client, error) {
 	}
 	if ok, _ := c.Extension("STARTTLS"); ok {
 		config := &tls.Config{ServerName: server}
-		if h.config.DisableSSLVerification {
+		if h.getConfig().DisableSSLVerification {
 			config.InsecureSkipVerify = true
 		}
 		if err := c.StartTLS(config); err != nil {
@@ -140,15 +147,14 @@ func (h *Host) deliverToMailServer(c *smtp.Client, m *Message) error {
 		return err
 	}
 	defer r.Close()
-	r, err = dkimSigned(m.From, r, h.config)
-	if err != nil {
-		return err
-	}
 	if err := c.Mail(m.From); err != nil {
 		return err
 	}
 	for _, t := range m.To {
 		if err := c.Rcpt(t); err != nil {
+			if e, ok := err.(*textproto.Error); ok && e.Code >= 500 && e.Code <= 599 {
+				h.suppress(t, e)
+			}
 			return err
 		}
 	}
@@ -163,6 +169,15 @@ func (h *Host) deliverToMailServer(c *smtp.Client, m *Message) error {
 	return nil
 }
 
+// Add a recipient rejected with a permanent failure to the suppression list.
+func (h *Host) suppress(address string, e *textproto.Error) {
+	if _, err := h.storage.Suppress(address, fmt.Sprintf("rejected: %d %s", e.Code, e.Msg)); err != nil {
+		h.log.Error(err.Error())
+		return
+	}
+	h.log.Infof("%s added to suppression list", address)
+}
+
 // Receive message and deliver them to their recipients. Due to the complicated
 // algorithm for message delivery, the body of the method is broken up into a
 // sequence of labeled sections.
@@ -174,7 +189,6 @@ func (h *Host) run() {
 		c        *smtp.Client
 		err      error
 		tries    int
-		duration = time.Minute
 	)
 receive:
 	if m == nil {
@@ -235,20 +249,16 @@ wait:
 	// We differ a tiny bit from the RFC spec here but this should work well
 	// enough - the goal is to retry lots of times early on and space out the
 	// remaining attempts as time goes on. (Roughly 48 hours total.)
-	switch {
-	case tries < 8:
-		duration *= 2
-	case tries < 18:
-	default:
+	tries++
+	if tries >= h.getConfig().maxRetries() {
 		h.log.Error("maximum retry count exceeded")
 		goto cleanup
 	}
 	select {
 	case <-h.stop:
-	case <-time.After(duration):
+	case <-time.After(h.getConfig().retryDelay(tries)):
 		goto receive
 	}
-	tries++
 shutdown:
 	h.log.Debug("shutting down")
 	if c != nil {
@@ -275,6 +285,13 @@ func (h *Host) Deliver(m *Message) {
 	h.newMessage.Send <- m
 }
 
+// Use the specified configuration for subsequent deliveries.
+func (h *Host) SetConfig(c *Config) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.config = c
+}
+
 // Retrieve the connection idle time.
 func (h *Host) Idle() time.Duration {
 	h.m.Lock()
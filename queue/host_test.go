@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHostMaxRetries(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{
+		From: "me@example.invalid",
+		To:   []string{"you@example.invalid"},
+	}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	// The host cannot be reached, so each attempt fails immediately and the
+	// only delay is the single wait of twice the retry interval
+	h := NewHost("example.invalid", s, &Config{
+		RetryInterval: 1,
+		MaxRetries:    2,
+	})
+	defer h.Stop()
+	start := time.Now()
+	h.Deliver(m)
+	for {
+		if messages, _ := s.Usage(); messages == 0 {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("message was not abandoned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second || elapsed >= 6*time.Second {
+		t.Fatalf("message abandoned after %s", elapsed)
+	}
+}
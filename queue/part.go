@@ -0,0 +1,203 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	partsDirectory = "parts"
+	partsFilename  = "parts"
+	partPrefix     = "part-"
+)
+
+// Content stored once and shared by several bodies, such as an attachment
+// sent to each recipient of a batch. Each body references the part through a
+// hard link, so the content remains on disk until the last body using it is
+// deleted, even after the part itself has been deleted.
+type Part struct {
+	name   string
+	format string
+}
+
+// Find a file stored in any compression format, returning its filename and
+// format.
+func findFile(name string) (string, string, error) {
+	for format, ext := range compressionExtensions {
+		f := name + ext
+		if _, err := os.Stat(f); err == nil {
+			return f, format, nil
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	return "", "", &os.PathError{
+		Op:   "open",
+		Path: name,
+		Err:  os.ErrNotExist,
+	}
+}
+
+// Writer for the content of a new part.
+type PartWriter struct {
+	io.WriteCloser
+}
+
+// Abandon the part. This must be called instead of Close() if the content
+// cannot be completed.
+func (p *PartWriter) Abort() {
+	discardWriter(p.WriteCloser)
+}
+
+// Create a new part that can be added to bodies once the writer has been
+// closed. The content is compressed and encrypted in the same way as bodies.
+func (s *Storage) NewPart() (*PartWriter, *Part, error) {
+	if err := os.MkdirAll(path.Join(s.directory, partsDirectory), 0700); err != nil {
+		return nil, nil, err
+	}
+	p := &Part{
+		format: s.compression,
+	}
+	p.name = path.Join(s.directory, partsDirectory, uuid.New()) + compressionExtensions[p.format]
+	f, e, err := s.createFile(p.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := newCompressWriter(e, p.format)
+	if err != nil {
+		f.discard()
+		return nil, nil, err
+	}
+	return &PartWriter{WriteCloser: w}, p, nil
+}
+
+// Open the specified file for reading, decrypting and decompressing it.
+func (s *Storage) openCompressedFile(name, format string) (io.ReadCloser, error) {
+	r, err := s.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDecompressReader(r, format)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Delete the part. Bodies that it was added to are not affected.
+func (p *Part) Delete() error {
+	return os.Remove(p.name)
+}
+
+// Remove parts left behind by an interrupted batch. Parts are only needed
+// while bodies are being written, so any that exist at startup are unused.
+func (s *Storage) removeParts() error {
+	return os.RemoveAll(path.Join(s.directory, partsDirectory))
+}
+
+// Add a part to the body at the current position. The part is linked into
+// the body directory and its offset recorded so that it can be spliced into
+// the body when it is read.
+func (b *BodyWriter) WritePart(p *Part) error {
+	name := path.Join(
+		b.storage.bodyDirectory(b.body),
+		fmt.Sprintf("%s%d", partPrefix, len(b.parts)),
+	) + compressionExtensions[p.format]
+	if err := os.Link(p.name, name); err != nil {
+		return err
+	}
+	if b.dkim != nil {
+		r, err := b.storage.openCompressedFile(name, p.format)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err := io.Copy(b.dkim, r); err != nil {
+			return err
+		}
+	}
+	b.parts = append(b.parts, b.written)
+	return nil
+}
+
+// Store the offsets of the parts in the body. Like the signatures, this is
+// done before the body is moved into place.
+func (b *BodyWriter) writeParts() error {
+	f, w, err := b.storage.createFile(path.Join(b.storage.bodyDirectory(b.body), partsFilename))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(b.parts); err != nil {
+		f.discard()
+		return err
+	}
+	return w.Close()
+}
+
+// Reader for a body with its parts spliced in.
+type partReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close the body and all of its parts.
+func (p *partReader) Close() error {
+	var err error
+	for _, c := range p.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Splice the parts of the specified body into the reader for it, if it has
+// any. The reader is closed if the parts cannot be opened.
+func (s *Storage) readParts(body string, r io.ReadCloser) (io.ReadCloser, error) {
+	f, err := s.openFile(path.Join(s.bodyDirectory(body), partsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		r.Close()
+		return nil, err
+	}
+	var offsets []int64
+	err = json.NewDecoder(f).Decode(&offsets)
+	f.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	var (
+		p       = &partReader{closers: []io.Closer{r}}
+		readers []io.Reader
+		last    int64
+	)
+	for i, offset := range offsets {
+		name, format, err := findFile(path.Join(
+			s.bodyDirectory(body),
+			fmt.Sprintf("%s%d", partPrefix, i),
+		))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		c, err := s.openCompressedFile(name, format)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.closers = append(p.closers, c)
+		readers = append(readers, io.LimitReader(r, offset-last), c)
+		last = offset
+	}
+	p.Reader = io.MultiReader(append(readers, r)...)
+	return p, nil
+}
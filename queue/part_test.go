@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParts(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, err := NewStorageFromConfig(&Config{
+		Directory:   d,
+		Compression: compressionGzip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, p, err := s.NewPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write([]byte("shared")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var messages []*Message
+	for i := 0; i < 2; i++ {
+		w, body, err := s.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"a", "", "b", "", "c"} {
+			if v == "" {
+				err = w.WritePart(p)
+			} else {
+				_, err = w.Write([]byte(v))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		m := &Message{}
+		if err := s.SaveMessage(m, body); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, m)
+	}
+	if err := p.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		r, err := s.GetMessageBody(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "asharedbsharedc" {
+			t.Fatalf("%s != asharedbsharedc", b)
+		}
+		if err := s.DeleteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.LoadMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(d, partsDirectory)); !os.IsNotExist(err) {
+		t.Fatal("parts directory should be removed")
+	}
+}
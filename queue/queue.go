@@ -3,30 +3,45 @@ package queue
 import (
 	"github.com/sirupsen/logrus"
 
+	"reflect"
+	"sync"
 	"time"
 )
 
 // Queue status information.
 type QueueStatus struct {
-	Uptime int                    `json:"uptime"`
-	Hosts  map[string]*HostStatus `json:"hosts"`
+	Uptime       int                    `json:"uptime"`
+	Messages     int                    `json:"messages"`
+	Bytes        int64                  `json:"bytes"`
+	Backpressure bool                   `json:"backpressure"`
+	Hosts        map[string]*HostStatus `json:"hosts"`
 }
 
 // Mail queue managing the sending of messages to hosts.
 type Queue struct {
+	m          sync.Mutex
 	config     *Config
 	Storage    *Storage
+	DKIM       *DKIMRegistry
 	log        *logrus.Entry
 	hosts      map[string]*Host
 	newMessage chan *Message
 	getStats   chan chan *QueueStatus
+	reload     chan *Config
 	stop       chan bool
 }
 
+// Retrieve the current configuration.
+func (q *Queue) getConfig() *Config {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.config
+}
+
 // Deliver the specified message to the appropriate host queue.
 func (q *Queue) deliverMessage(m *Message) {
 	if _, ok := q.hosts[m.Host]; !ok {
-		q.hosts[m.Host] = NewHost(m.Host, q.Storage, q.config)
+		q.hosts[m.Host] = NewHost(m.Host, q.Storage, q.getConfig())
 	}
 	q.hosts[m.Host].Deliver(m)
 }
@@ -36,9 +51,11 @@ func (q *Queue) deliverMessage(m *Message) {
 func (q *Queue) stats(c chan *QueueStatus, startTime time.Time) {
 	go func() {
 		s := &QueueStatus{
-			Uptime: int(time.Now().Sub(startTime) / time.Second),
-			Hosts:  map[string]*HostStatus{},
+			Uptime:       int(time.Now().Sub(startTime) / time.Second),
+			Backpressure: q.CheckCapacity() != nil,
+			Hosts:        map[string]*HostStatus{},
 		}
+		s.Messages, s.Bytes = q.Storage.Usage()
 		for n, h := range q.hosts {
 			s.Hosts[n] = h.Status()
 		}
@@ -71,6 +88,10 @@ loop:
 			q.deliverMessage(m)
 		case c := <-q.getStats:
 			q.stats(c, startTime)
+		case c := <-q.reload:
+			for _, h := range q.hosts {
+				h.SetConfig(c)
+			}
 		case <-ticker.C:
 			q.checkForInactiveQueues()
 		case <-q.stop:
@@ -78,22 +99,39 @@ loop:
 		}
 	}
 	q.log.Info("stopping host queues")
-	for h := range q.hosts {
-		q.hosts[h].Stop()
+	var wg sync.WaitGroup
+	for _, h := range q.hosts {
+		wg.Add(1)
+		go func(h *Host) {
+			h.Stop()
+			wg.Done()
+		}(h)
 	}
+	wg.Wait()
 	q.log.Info("shutting down")
 }
 
 // Create a new message queue. Any undelivered messages on disk will be added
 // to the appropriate queue.
 func NewQueue(c *Config) (*Queue, error) {
+	s, err := NewStorageFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDKIMRegistry(c)
+	if err != nil {
+		return nil, err
+	}
+	s.dkim = d
 	q := &Queue{
 		config:     c,
-		Storage:    NewStorage(c.Directory),
+		Storage:    s,
+		DKIM:       d,
 		log:        logrus.WithField("context", "Queue"),
 		hosts:      make(map[string]*Host),
 		newMessage: make(chan *Message),
 		getStats:   make(chan chan *QueueStatus),
+		reload:     make(chan *Config),
 		stop:       make(chan bool),
 	}
 	messages, err := q.Storage.LoadMessages()
@@ -120,8 +158,71 @@ func (q *Queue) Deliver(m *Message) {
 	q.newMessage <- m
 }
 
+// Validate the specified configuration and load the keys it requires,
+// returning a function that applies it to the queue and all host queues
+// without interrupting deliveries. Nothing is changed until the function is
+// called. Settings that affect storage cannot be changed while the queue is
+// running and are retained from the current configuration.
+func (q *Queue) PrepareReload(c *Config) (func(), error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var (
+		old = q.getConfig()
+		n   = *c
+	)
+	if n.Directory != old.Directory ||
+		n.Compression != old.Compression ||
+		!reflect.DeepEqual(n.EncryptionKeys, old.EncryptionKeys) {
+		q.log.Warning("storage settings cannot be changed without a restart")
+		n.Directory = old.Directory
+		n.Compression = old.Compression
+		n.EncryptionKeys = old.EncryptionKeys
+	}
+	applyDKIM, err := q.DKIM.prepare(&n)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		applyDKIM()
+		q.Storage.setVERP(n.BounceDomain, n.BounceSecret)
+		q.m.Lock()
+		q.config = &n
+		q.m.Unlock()
+		q.reload <- &n
+		q.log.Info("configuration reloaded")
+	}, nil
+}
+
+// Apply the specified configuration.
+func (q *Queue) Reload(c *Config) error {
+	apply, err := q.PrepareReload(c)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
 // Stop all active host queues.
 func (q *Queue) Stop() {
 	q.stop <- true
 	<-q.stop
 }
+
+// Stop all active host queues, waiting up to the specified amount of time for
+// messages currently being delivered to finish. Messages that are still being
+// delivered when the timeout expires remain on disk and are delivered again
+// when the queue is next started.
+func (q *Queue) Drain(timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		q.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		q.log.Warning("timed out waiting for deliveries to finish")
+	}
+}
@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	recordsDirectory = "records"
+	recordExtension  = ".json"
+)
+
+// Determine the filename of the specified record.
+func (s *Storage) recordFilename(kind, name string) string {
+	return path.Join(s.directory, recordsDirectory, kind, name) + recordExtension
+}
+
+// Save a value as a record of the specified kind. Records are small JSON
+// documents kept alongside the queue by other parts of the application. They
+// are written atomically and encrypted in the same way as messages. The name
+// must be a valid filename.
+func (s *Storage) SaveRecord(kind, name string, v interface{}) error {
+	if err := os.MkdirAll(path.Join(s.directory, recordsDirectory, kind), 0700); err != nil {
+		return err
+	}
+	f, w, err := s.createFile(s.recordFilename(kind, name))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.discard()
+		return err
+	}
+	return w.Close()
+}
+
+// Load the specified record into the provided value. If the record does not
+// exist, an error satisfying os.IsNotExist() is returned.
+func (s *Storage) LoadRecord(kind, name string, v interface{}) error {
+	r, err := s.openFile(s.recordFilename(kind, name))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// Delete the specified record.
+func (s *Storage) DeleteRecord(kind, name string) error {
+	return os.Remove(s.recordFilename(kind, name))
+}
+
+// Retrieve the names of all records of the specified kind.
+func (s *Storage) Records(kind string) ([]string, error) {
+	d, err := os.Open(path.Join(s.directory, recordsDirectory, kind))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer d.Close()
+	files, err := d.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f, recordExtension) {
+			names = append(names, strings.TrimSuffix(f, recordExtension))
+		}
+	}
+	return names, nil
+}
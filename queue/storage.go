@@ -14,6 +14,7 @@ import (
 
 const (
 	bodyFilename     = "body"
+	dkimFilename     = "dkim"
 	messageExtension = ".message"
 )
 
@@ -26,11 +27,103 @@ type Message struct {
 	To   []string
 }
 
+// Retrieve the unique identifier assigned to the message when it was saved.
+func (m *Message) ID() string {
+	return m.id
+}
+
 // Manager for message metadata and body on disk. All methods are safe to call
 // from multiple goroutines.
 type Storage struct {
-	m         sync.Mutex
-	directory string
+	m            sync.Mutex
+	directory    string
+	compression  string
+	keys         *keyring
+	bounceDomain string
+	bounceSecret string
+	dkim         *DKIMRegistry
+	messages     int
+	bytes        int64
+	uploadBytes  int64
+	uploadMutex  sync.Mutex
+}
+
+// Writer for a new body that records the size of the body on disk once it has
+// been written. If the body is being signed, the DKIM signatures are computed
+// as it is written and stored alongside it.
+type BodyWriter struct {
+	io.WriteCloser
+	dkim    *dkimWriter
+	storage *Storage
+	body    string
+	parts   []int64
+	written int64
+}
+
+// Write data to the body and to the DKIM signers, if any.
+func (b *BodyWriter) Write(p []byte) (int, error) {
+	if b.dkim != nil {
+		if _, err := b.dkim.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.WriteCloser.Write(p)
+	b.written += int64(n)
+	return n, err
+}
+
+// Store the DKIM signatures for the body. This is done before the body itself
+// is moved into place so that a body is never visible without them.
+func (b *BodyWriter) writeSignatures() error {
+	headers, err := b.dkim.signatures()
+	if err != nil {
+		return err
+	}
+	f, w, err := b.storage.createFile(path.Join(b.storage.bodyDirectory(b.body), dkimFilename))
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, headers); err != nil {
+		f.discard()
+		return err
+	}
+	return w.Close()
+}
+
+// Abandon the body, removing anything that was written for it. This must be
+// called instead of Close() if the body cannot be completed.
+func (b *BodyWriter) Abort() {
+	if b.dkim != nil {
+		b.dkim.abort()
+	}
+	discardWriter(b.WriteCloser)
+	os.RemoveAll(b.storage.bodyDirectory(b.body))
+}
+
+// Close the body and add its size to the storage usage. Parts are not
+// included in the usage since they are shared with other bodies. If the body
+// cannot be written, it is removed.
+func (b *BodyWriter) Close() error {
+	if b.dkim != nil {
+		if err := b.writeSignatures(); err != nil {
+			b.Abort()
+			return err
+		}
+	}
+	if len(b.parts) != 0 {
+		if err := b.writeParts(); err != nil {
+			b.Abort()
+			return err
+		}
+	}
+	if err := b.WriteCloser.Close(); err != nil {
+		os.RemoveAll(b.storage.bodyDirectory(b.body))
+		return err
+	}
+	b.storage.m.Lock()
+	defer b.storage.m.Unlock()
+	b.storage.bytes += b.storage.bodySize(b.body)
+	return nil
 }
 
 // Determine the path to the directory containing the specified body.
@@ -38,9 +131,30 @@ func (s *Storage) bodyDirectory(body string) string {
 	return path.Join(s.directory, body)
 }
 
-// Determine the filename of the specified body.
-func (s *Storage) bodyFilename(body string) string {
-	return path.Join(s.bodyDirectory(body), bodyFilename)
+// Determine the filename of the specified body when stored in the specified
+// compression format.
+func (s *Storage) bodyFilename(body, format string) string {
+	return path.Join(s.bodyDirectory(body), bodyFilename+compressionExtensions[format])
+}
+
+// Determine the size of the specified body on disk, returning zero if it
+// cannot be found.
+func (s *Storage) bodySize(body string) int64 {
+	name, _, err := s.findBody(body)
+	if err != nil {
+		return 0
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Find the specified body on disk, returning its filename and compression
+// format.
+func (s *Storage) findBody(body string) (string, string, error) {
+	return findFile(s.bodyFilename(body, compressionNone))
 }
 
 // Determine the filename of the specified message.
@@ -58,7 +172,7 @@ func (s *Storage) loadMessages(body string) []*Message {
 					id:   strings.TrimSuffix(f.Name(), messageExtension),
 					body: body,
 				}
-				if r, err := os.Open(s.messageFilename(m)); err == nil {
+				if r, err := s.openFile(s.messageFilename(m)); err == nil {
 					if err := json.NewDecoder(r).Decode(m); err == nil {
 						messages = append(messages, m)
 					}
@@ -77,23 +191,119 @@ func NewStorage(directory string) *Storage {
 	}
 }
 
+// Create a Storage instance using the directory, compression format and
+// encryption keys in the specified configuration.
+func NewStorageFromConfig(c *Config) (*Storage, error) {
+	if err := checkCompression(c.Compression); err != nil {
+		return nil, err
+	}
+	keys, err := newKeyring(c.EncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{
+		directory:    c.Directory,
+		compression:  c.Compression,
+		keys:         keys,
+		bounceDomain: c.BounceDomain,
+		bounceSecret: c.BounceSecret,
+	}, nil
+}
+
+// Create the specified file. Data written to the file is encrypted if keys
+// were provided. The file is written atomically when the writer is closed.
+func (s *Storage) createFile(name string) (*atomicFile, io.WriteCloser, error) {
+	f, err := newAtomicFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.keys == nil {
+		return f, f, nil
+	}
+	w, err := s.keys.newWriter(f)
+	if err != nil {
+		f.discard()
+		return nil, nil, err
+	}
+	return f, w, nil
+}
+
+// Open the specified file for reading, decrypting it if necessary.
+func (s *Storage) openFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.keys.newReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
 // Create a new message body. The writer must be closed after writing the
-// message body.
-func (s *Storage) NewBody() (io.WriteCloser, string, error) {
+// message body or aborted if it cannot be completed. The body is written to a
+// temporary file and only becomes visible once Close() has returned without
+// error, at which point it is guaranteed to be on disk.
+func (s *Storage) NewBody() (*BodyWriter, string, error) {
+	return s.newBody(nil)
+}
+
+// Create a new message body that is signed with the DKIM signatures for the
+// specified sender's domain. The signatures are computed once while the body
+// is written instead of each time it is delivered.
+func (s *Storage) NewSignedBody(from string) (*BodyWriter, string, error) {
+	d, err := s.dkim.newWriter(from)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.newBody(d)
+}
+
+// Create a new message body, computing the specified DKIM signatures.
+func (s *Storage) newBody(d *dkimWriter) (*BodyWriter, string, error) {
 	body := uuid.New()
+	abort := func() {
+		if d != nil {
+			d.abort()
+		}
+		os.RemoveAll(s.bodyDirectory(body))
+	}
 	if err := os.MkdirAll(s.bodyDirectory(body), 0700); err != nil {
+		abort()
 		return nil, "", err
 	}
-	w, err := os.OpenFile(s.bodyFilename(body), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err := syncDir(s.directory); err != nil {
+		abort()
+		return nil, "", err
+	}
+	f, e, err := s.createFile(s.bodyFilename(body, s.compression))
+	if err != nil {
+		abort()
+		return nil, "", err
+	}
+	w, err := newCompressWriter(e, s.compression)
 	if err != nil {
+		f.discard()
+		abort()
 		return nil, "", err
 	}
-	return w, body, nil
+	return &BodyWriter{
+		WriteCloser: w,
+		dkim:        d,
+		storage:     s,
+		body:        body,
+	}, body, nil
 }
 
 // Load messages from the storage directory. Any messages that could not be
-// loaded are ignored.
+// loaded are ignored. The usage of the storage is calculated from the messages
+// that were loaded and any uploads.
 func (s *Storage) LoadMessages() ([]*Message, error) {
+	if err := s.removeParts(); err != nil {
+		return nil, err
+	}
 	directories, err := ioutil.ReadDir(s.directory)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -101,39 +311,108 @@ func (s *Storage) LoadMessages() ([]*Message, error) {
 		}
 		return []*Message{}, nil
 	}
-	var messages []*Message
+	var (
+		messages []*Message
+		bytes    int64
+	)
 	for _, d := range directories {
 		if d.IsDir() {
-			if _, err := os.Stat(s.bodyFilename(d.Name())); err == nil {
+			if _, _, err := s.findBody(d.Name()); err == nil {
 				messages = append(messages, s.loadMessages(d.Name())...)
+				bytes += s.bodySize(d.Name())
 			}
 		}
 	}
+	uploadBytes, err := s.uploadsSize()
+	if err != nil {
+		return nil, err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.messages = len(messages)
+	s.bytes = bytes
+	s.uploadBytes = uploadBytes
 	return messages, nil
 }
 
-// Save the specified message to disk.
+// Save the specified message to disk. The message is guaranteed to be on disk
+// when this method returns without error. An ID is assigned to the message
+// unless it was created with one.
 func (s *Storage) SaveMessage(m *Message, body string) error {
 	s.m.Lock()
 	defer s.m.Unlock()
-	m.id = uuid.New()
+	if m.id == "" {
+		m.id = uuid.New()
+	}
 	m.body = body
-	w, err := os.OpenFile(s.messageFilename(m), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	f, w, err := s.createFile(s.messageFilename(m))
 	if err != nil {
 		return err
 	}
-	defer w.Close()
 	if err := json.NewEncoder(w).Encode(m); err != nil {
+		f.discard()
 		return err
 	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	s.messages++
 	return nil
 }
 
-// Retreive a reader for the message body.
+// Reader for a body with its DKIM signatures prepended.
+type signedBodyReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Read the DKIM signatures stored for the specified body, returning an empty
+// string if the body is not signed.
+func (s *Storage) bodySignatures(body string) (string, error) {
+	r, err := s.openFile(path.Join(s.bodyDirectory(body), dkimFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Retreive a reader for the message body. Compressed and encrypted bodies are
+// decompressed and decrypted transparently and any shared parts are spliced
+// in. If the body was signed, its DKIM signatures are prepended.
 func (s *Storage) GetMessageBody(m *Message) (io.ReadCloser, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
-	return os.Open(s.bodyFilename(m.body))
+	name, format, err := s.findBody(m.body)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := s.bodySignatures(m.body)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.openCompressedFile(name, format)
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.readParts(m.body, r)
+	if err != nil {
+		return nil, err
+	}
+	if headers == "" {
+		return d, nil
+	}
+	return &signedBodyReader{
+		Reader: io.MultiReader(strings.NewReader(headers), d),
+		Closer: d,
+	}, nil
 }
 
 // Delete the specified message. The message body is also deleted if no more
@@ -144,17 +423,24 @@ func (s *Storage) DeleteMessage(m *Message) error {
 	if err := os.Remove(s.messageFilename(m)); err != nil {
 		return err
 	}
-	d, err := os.Open(s.bodyDirectory(m.body))
-	if err != nil {
-		return err
-	}
-	defer d.Close()
-	e, err := d.Readdir(2)
+	s.messages--
+	files, err := ioutil.ReadDir(s.bodyDirectory(m.body))
 	if err != nil {
 		return err
 	}
-	if len(e) == 1 {
-		return os.RemoveAll(s.bodyDirectory(m.body))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), messageExtension) {
+			return nil
+		}
 	}
-	return nil
+	s.bytes -= s.bodySize(m.body)
+	return os.RemoveAll(s.bodyDirectory(m.body))
+}
+
+// Retrieve the number of messages in storage and the number of bytes used by
+// their bodies and by uploads.
+func (s *Storage) Usage() (int, int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.messages, s.bytes + s.uploadBytes
 }
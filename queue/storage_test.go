@@ -1,9 +1,11 @@
 package queue
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -64,3 +66,147 @@ func TestStorage(t *testing.T) {
 		t.Fatalf("%d != 0", len(e))
 	}
 }
+
+func TestStorageIncompleteBody(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	w, body, err := s.NewBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveMessage(&Message{}, body); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := s.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("%d != 0", len(messages))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = s.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("%d != 1", len(messages))
+	}
+}
+
+func TestStorageCompression(t *testing.T) {
+	data := []byte("test")
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	for _, format := range []string{compressionNone, compressionGzip, compressionZstd} {
+		s.compression = format
+		w, body, err := s.NewBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SaveMessage(&Message{}, body); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(s.bodyFilename(body, format)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.compression = compressionGzip
+	messages, err := s.LoadMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("%d != 3", len(messages))
+	}
+	for _, m := range messages {
+		r, err := s.GetMessageBody(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b, data) {
+			t.Fatalf("%v != %v", b, data)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStorageDKIM(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	r, err := NewDKIMRegistry(&Config{
+		DKIMConfigs: map[string]DKIMConfigList{
+			"example.org": {
+				{
+					PrivateKey: privKey,
+					Selector:   "test",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStorage(d)
+	s.dkim = r
+	w, body, err := s.NewSignedBody(sampleFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, sampleMessage); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{}
+	if err := s.SaveMessage(m, body); err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.GetMessageBody(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(b)
+	b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "DKIM-Signature:") {
+		t.Fatal("DKIM-Signature expected")
+	}
+	if !strings.HasSuffix(string(data), sampleMessage) {
+		t.Fatal("message body expected")
+	}
+	if err := s.DeleteMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.bodyDirectory(body)); !os.IsNotExist(err) {
+		t.Fatal("body directory was not removed")
+	}
+}
@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// Record kind used for storing suppressions.
+const suppressionRecord = "suppressions"
+
+var errSuppressionAddress = errors.New("address is required")
+
+// Recipient address that mail is no longer sent to.
+type Suppression struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"time"`
+}
+
+// Extract the address from a value that may include a display name.
+func normalizeAddress(address string) string {
+	if a, err := mail.ParseAddress(address); err == nil {
+		return a.Address
+	}
+	return strings.TrimSpace(address)
+}
+
+// Normalize an address for comparison, returning the record name for it.
+// Addresses are compared without regard to case or display name and encoded
+// so that any address is a valid filename.
+func suppressionName(address string) string {
+	return hex.EncodeToString([]byte(strings.ToLower(normalizeAddress(address))))
+}
+
+// Add an address to the suppression list, replacing any existing entry.
+func (s *Storage) Suppress(address, reason string) (*Suppression, error) {
+	address = normalizeAddress(address)
+	if address == "" {
+		return nil, errSuppressionAddress
+	}
+	v := &Suppression{
+		Address: address,
+		Reason:  reason,
+		Time:    time.Now(),
+	}
+	if err := s.SaveRecord(suppressionRecord, suppressionName(address), v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Remove an address from the suppression list. If the address is not in the
+// list, an error satisfying os.IsNotExist() is returned.
+func (s *Storage) Unsuppress(address string) error {
+	return s.DeleteRecord(suppressionRecord, suppressionName(address))
+}
+
+// Retrieve all of the entries in the suppression list.
+func (s *Storage) Suppressions() ([]*Suppression, error) {
+	names, err := s.Records(suppressionRecord)
+	if err != nil {
+		return nil, err
+	}
+	suppressions := make([]*Suppression, 0, len(names))
+	for _, n := range names {
+		v := &Suppression{}
+		if err := s.LoadRecord(suppressionRecord, n, v); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		suppressions = append(suppressions, v)
+	}
+	return suppressions, nil
+}
+
+// Determine whether an address is in the suppression list.
+func (s *Storage) IsSuppressed(address string) (bool, error) {
+	_, err := os.Stat(s.recordFilename(suppressionRecord, suppressionName(address)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Split a list of addresses into those that may receive mail and those in the
+// suppression list.
+func (s *Storage) FilterSuppressed(addresses []string) ([]string, []string, error) {
+	var allowed, suppressed []string
+	for _, a := range addresses {
+		ok, err := s.IsSuppressed(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			suppressed = append(suppressed, a)
+		} else {
+			allowed = append(allowed, a)
+		}
+	}
+	return allowed, suppressed, nil
+}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSuppression(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	if _, err := s.Suppress("User <User/1@example.com>", "complaint"); err != nil {
+		t.Fatal(err)
+	}
+	allowed, suppressed, err := s.FilterSuppressed([]string{"user/1@EXAMPLE.com", "user2@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 1 || len(suppressed) != 1 {
+		t.Fatalf("%v, %v", allowed, suppressed)
+	}
+	l, err := s.Suppressions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].Address != "User/1@example.com" || l[0].Reason != "complaint" {
+		t.Fatalf("unexpected suppressions %v", l)
+	}
+	if ok, err := s.IsSuppressed("Someone <USER/1@example.com>"); err != nil || !ok {
+		t.Fatal("address with display name should be suppressed")
+	}
+	if err := s.Unsuppress(" User <user/1@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.IsSuppressed("user/1@example.com"); err != nil || ok {
+		t.Fatal("address should not be suppressed")
+	}
+	if err := s.Unsuppress("user/1@example.com"); !os.IsNotExist(err) {
+		t.Fatal("os.IsNotExist() error expected")
+	}
+}
@@ -0,0 +1,174 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	uploadsDirectory = "uploads"
+	uploadRecord     = "uploads"
+)
+
+var errUploadID = errors.New("invalid upload ID")
+
+// File uploaded for use as an attachment. The time is updated each time the
+// upload is used so that uploads are only expired once they are no longer
+// being used.
+type Upload struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Time        time.Time `json:"time"`
+}
+
+// Determine the filename for the content of an upload.
+func (s *Storage) uploadFilename(id string) string {
+	return path.Join(s.directory, uploadsDirectory, id)
+}
+
+// Determine the size of the content of an upload on disk, returning zero if
+// it cannot be found.
+func (s *Storage) uploadSize(id string) int64 {
+	fi, err := os.Stat(s.uploadFilename(id))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Determine the total size of all uploads on disk.
+func (s *Storage) uploadsSize() (int64, error) {
+	ids, err := s.Records(uploadRecord)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, id := range ids {
+		size += s.uploadSize(id)
+	}
+	return size, nil
+}
+
+// Add to the number of bytes used by uploads.
+func (s *Storage) addUploadBytes(n int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.uploadBytes += n
+}
+
+// Ensure that an upload ID was created by SaveUpload, which also ensures
+// that it is a valid filename.
+func checkUploadID(id string) error {
+	if uuid.Parse(id) == nil {
+		return errUploadID
+	}
+	return nil
+}
+
+// Save the content of an upload from the provided reader. The ID, size and
+// time of the upload are set. The content is written atomically and encrypted
+// in the same way as messages and is included in the storage usage.
+func (s *Storage) SaveUpload(u *Upload, r io.Reader) error {
+	if err := os.MkdirAll(path.Join(s.directory, uploadsDirectory), 0700); err != nil {
+		return err
+	}
+	u.ID = uuid.New()
+	f, w, err := s.createFile(s.uploadFilename(u.ID))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		f.discard()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	u.Size = n
+	u.Time = time.Now()
+	if err := s.SaveRecord(uploadRecord, u.ID, u); err != nil {
+		os.Remove(s.uploadFilename(u.ID))
+		return err
+	}
+	s.addUploadBytes(s.uploadSize(u.ID))
+	return nil
+}
+
+// Load the details of the specified upload and mark it as used. If the
+// upload does not exist, an error satisfying os.IsNotExist() is returned.
+func (s *Storage) UseUpload(id string) (*Upload, error) {
+	if err := checkUploadID(id); err != nil {
+		return nil, err
+	}
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+	u := &Upload{}
+	if err := s.LoadRecord(uploadRecord, id, u); err != nil {
+		return nil, err
+	}
+	u.Time = time.Now()
+	if err := s.SaveRecord(uploadRecord, id, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Open the content of the specified upload for reading.
+func (s *Storage) OpenUpload(id string) (io.ReadCloser, error) {
+	if err := checkUploadID(id); err != nil {
+		return nil, err
+	}
+	return s.openFile(s.uploadFilename(id))
+}
+
+// Delete the specified upload.
+func (s *Storage) DeleteUpload(id string) error {
+	if err := checkUploadID(id); err != nil {
+		return err
+	}
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+	return s.deleteUpload(id)
+}
+
+// Delete an upload and remove its size from the storage usage. The upload
+// mutex must be held.
+func (s *Storage) deleteUpload(id string) error {
+	size := s.uploadSize(id)
+	if err := os.Remove(s.uploadFilename(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.addUploadBytes(-size)
+	return s.DeleteRecord(uploadRecord, id)
+}
+
+// Delete uploads that have not been used since the specified time, returning
+// the number that were deleted.
+func (s *Storage) ExpireUploads(before time.Time) (int, error) {
+	ids, err := s.Records(uploadRecord)
+	if err != nil {
+		return 0, err
+	}
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+	n := 0
+	for _, id := range ids {
+		u := &Upload{}
+		if err := s.LoadRecord(uploadRecord, id, u); err == nil && !u.Time.Before(before) {
+			continue
+		}
+		if err := s.deleteUpload(id); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
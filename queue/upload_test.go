@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpload(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	u := &Upload{Filename: "test.txt"}
+	if err := s.SaveUpload(u, strings.NewReader("test")); err != nil {
+		t.Fatal(err)
+	}
+	if u.Size != 4 {
+		t.Fatalf("%d != 4", u.Size)
+	}
+	if _, err := s.UseUpload("../" + u.ID); err != errUploadID {
+		t.Fatalf("%v != %v", err, errUploadID)
+	}
+	loaded, err := s.UseUpload(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Filename != u.Filename {
+		t.Fatalf("%s != %s", loaded.Filename, u.Filename)
+	}
+	r, err := s.OpenUpload(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "test" {
+		t.Fatalf("%s != test", b)
+	}
+	if n, err := s.ExpireUploads(loaded.Time.Add(-time.Minute)); err != nil || n != 0 {
+		t.Fatalf("%d != 0 (%v)", n, err)
+	}
+	if n, err := s.ExpireUploads(loaded.Time.Add(time.Minute)); err != nil || n != 1 {
+		t.Fatalf("%d != 1 (%v)", n, err)
+	}
+	if _, err := s.OpenUpload(u.ID); !os.IsNotExist(err) {
+		t.Fatal("os.IsNotExist() error expected")
+	}
+}
+
+func TestUploadConcurrentUse(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	u := &Upload{Filename: "test.txt"}
+	if err := s.SaveUpload(u, strings.NewReader("test")); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 20)
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.UseUpload(u.ID); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if _, err := s.UseUpload(u.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadUsage(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s := NewStorage(d)
+	u := &Upload{Filename: "test.txt"}
+	if err := s.SaveUpload(u, strings.NewReader("test")); err != nil {
+		t.Fatal(err)
+	}
+	if _, bytes := s.Usage(); bytes != 4 {
+		t.Fatalf("%d != 4", bytes)
+	}
+	s = NewStorage(d)
+	if _, err := s.LoadMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if _, bytes := s.Usage(); bytes != 4 {
+		t.Fatalf("%d != 4", bytes)
+	}
+	if err := s.DeleteUpload(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, bytes := s.Usage(); bytes != 0 {
+		t.Fatalf("%d != 0", bytes)
+	}
+}
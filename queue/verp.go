@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"github.com/pborman/uuid"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Local part prefix of VERP return paths.
+const verpPrefix = "bounces+"
+
+// Compute the signature of a VERP return path. It is truncated to keep the
+// local part short and covers the lowercase recipient since servers may not
+// preserve its case.
+func verpSignature(secret, id, recipient string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(id + "=" + strings.ToLower(recipient)))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Create a VERP return path for a message to the specified recipient. The
+// address has the form
+// bounces+<message-id>.<signature>=<local>=<domain>@<bounce-domain>.
+func VERPAddress(bounceDomain, secret, id, recipient string) string {
+	return verpPrefix + id + "." + verpSignature(secret, id, recipient) + "=" +
+		strings.Replace(recipient, "@", "=", -1) + "@" + bounceDomain
+}
+
+// Extract the message ID and recipient from a VERP return path. False is
+// returned if the address is not a return path for the bounce domain or its
+// signature is invalid.
+func ParseVERP(bounceDomain, secret, address string) (string, string, bool) {
+	i := strings.LastIndex(address, "@")
+	if i == -1 || !strings.EqualFold(address[i+1:], bounceDomain) {
+		return "", "", false
+	}
+	local := address[:i]
+	if !strings.HasPrefix(strings.ToLower(local), verpPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(local[len(verpPrefix):], "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	k := strings.LastIndex(parts[0], ".")
+	if k <= 0 {
+		return "", "", false
+	}
+	j := strings.LastIndex(parts[1], "=")
+	if j <= 0 || j == len(parts[1])-1 {
+		return "", "", false
+	}
+	var (
+		id        = parts[0][:k]
+		signature = strings.ToLower(parts[0][k+1:])
+		recipient = parts[1][:j] + "@" + parts[1][j+1:]
+	)
+	if !hmac.Equal([]byte(signature), []byte(verpSignature(secret, id, recipient))) {
+		return "", "", false
+	}
+	return id, recipient, true
+}
+
+// Set the domain and secret used for VERP return paths. An empty domain
+// disables VERP.
+func (s *Storage) setVERP(bounceDomain, bounceSecret string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.bounceDomain = bounceDomain
+	s.bounceSecret = bounceSecret
+}
+
+// Create the messages for delivering a body to recipients on a single host.
+// Normally a single message is created. If VERP is enabled, each recipient
+// receives a separate message whose return path identifies the message and
+// recipient. Messages with a null return path (such as bounces) never use
+// VERP since they must not generate bounces themselves. The messages are
+// assigned IDs immediately so that they can be referred to in the body. They
+// must be saved with SaveMessage.
+func (s *Storage) NewMessages(host, from string, to []string) []*Message {
+	s.m.Lock()
+	bounceDomain, bounceSecret := s.bounceDomain, s.bounceSecret
+	s.m.Unlock()
+	if bounceDomain == "" || from == "" {
+		return []*Message{{
+			id:   uuid.New(),
+			Host: host,
+			From: from,
+			To:   to,
+		}}
+	}
+	messages := make([]*Message, len(to))
+	for i, t := range to {
+		id := uuid.New()
+		messages[i] = &Message{
+			id:   id,
+			Host: host,
+			From: VERPAddress(bounceDomain, bounceSecret, id, t),
+			To:   []string{t},
+		}
+	}
+	return messages
+}
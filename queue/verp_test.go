@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVERP(t *testing.T) {
+	a := VERPAddress("bounce.example.org", "secret", "1234", "user+tag@example.com")
+	if !strings.HasPrefix(a, "bounces+1234.") || !strings.HasSuffix(a, "=user+tag=example.com@bounce.example.org") {
+		t.Fatalf("unexpected address %s", a)
+	}
+	id, recipient, ok := ParseVERP("BOUNCE.example.org", "secret", strings.ToUpper(a))
+	if !ok {
+		t.Fatal("address should be parsed")
+	}
+	if id != "1234" || recipient != "USER+TAG@EXAMPLE.COM" {
+		t.Fatalf("%s, %s != 1234, USER+TAG@EXAMPLE.COM", id, recipient)
+	}
+	id, recipient, ok = ParseVERP("BOUNCE.example.org", "secret", a)
+	if !ok {
+		t.Fatal("address should be parsed")
+	}
+	if id != "1234" || recipient != "user+tag@example.com" {
+		t.Fatalf("%s, %s != 1234, user+tag@example.com", id, recipient)
+	}
+	for _, a := range []string{
+		strings.Replace(a, "@bounce.example.org", "@example.com", 1),
+		strings.Replace(a, "=user+tag=", "=other=", 1),
+		VERPAddress("bounce.example.org", "other", "1234", "user+tag@example.com"),
+		"bounces+1234=user=example.com@bounce.example.org",
+		"user@bounce.example.org",
+		"bounces+1234@bounce.example.org",
+		"bounces+1234=user@bounce.example.org",
+	} {
+		if _, _, ok := ParseVERP("bounce.example.org", "secret", a); ok {
+			t.Fatalf("%s should not be parsed", a)
+		}
+	}
+}
+
+func TestStorageNewMessages(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, err := NewStorageFromConfig(&Config{
+		Directory:    d,
+		BounceDomain: "bounce.example.org",
+		BounceSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := []string{"a@example.com", "b@example.com"}
+	messages := s.NewMessages("example.com", "me@example.org", to)
+	if len(messages) != len(to) {
+		t.Fatalf("%d != %d", len(messages), len(to))
+	}
+	for i, m := range messages {
+		id, recipient, ok := ParseVERP("bounce.example.org", "secret", m.From)
+		if !ok || id != m.ID() || recipient != to[i] {
+			t.Fatalf("unexpected return path %s", m.From)
+		}
+	}
+	messages = s.NewMessages("example.com", "", to)
+	if len(messages) != 1 {
+		t.Fatalf("%d != 1", len(messages))
+	}
+	if messages[0].From != "" {
+		t.Fatalf("%s != \"\"", messages[0].From)
+	}
+	s.setVERP("", "")
+	if messages := s.NewMessages("example.com", "me@example.org", to); len(messages) != 1 {
+		t.Fatalf("%d != 1", len(messages))
+	}
+}
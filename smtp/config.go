@@ -1,23 +1,48 @@
 package smtp
 
 import (
-	"github.com/hectane/go-smtpsrv"
 	"github.com/hectane/hectane/version"
 
+	"errors"
 	"time"
 )
 
+// defaultMaxMessageSize is the maximum size of a message in bytes when none
+// is configured.
+const defaultMaxMessageSize = 25 * 1024 * 1024
+
 // Config stores configuration data for the SMTP server.
 type Config struct {
-	Addr        string `json:"addr"`
-	ReadTimeout int    `json:"read_timeout"`
+	Addr           string `json:"addr"`
+	ReadTimeout    int    `json:"read_timeout"`
+	MaxMessageSize int64  `json:"max_message_size"`
+}
+
+// banner returns the text sent to clients when they connect.
+func (c *Config) banner() string {
+	return "Hectane " + version.Version
+}
+
+// readTimeout returns the amount of time to wait for data from clients.
+func (c *Config) readTimeout() time.Duration {
+	return time.Duration(c.ReadTimeout) * time.Second
 }
 
-// smtpsrvConfig converts the config into one suitable for smtpsrv.
-func (c *Config) smtpsrvConfig() *smtpsrv.Config {
-	return &smtpsrv.Config{
-		Addr:        c.Addr,
-		Banner:      "Hectane " + version.Version,
-		ReadTimeout: time.Duration(c.ReadTimeout) * time.Second,
+// maxMessageSize returns the maximum size of a message in bytes.
+func (c *Config) maxMessageSize() int64 {
+	if c.MaxMessageSize == 0 {
+		return defaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Config) Validate() error {
+	if c.ReadTimeout < 0 {
+		return errors.New("read timeout cannot be negative")
+	}
+	if c.MaxMessageSize < 0 {
+		return errors.New("maximum message size cannot be negative")
 	}
+	return nil
 }
@@ -1,50 +1,173 @@
 package smtp
 
 import (
-	"github.com/sirupsen/logrus"
-	"github.com/hectane/go-smtpsrv"
-	"github.com/hectane/hectane/email"
 	"github.com/hectane/hectane/queue"
+	"github.com/sirupsen/logrus"
+
+	"net"
+	"sync"
+	"time"
 )
 
 // Server awaits incoming connections and delivers them to the mail queue.
 type Server struct {
-	server *smtpsrv.Server
-	queue  *queue.Queue
-	log    *logrus.Entry
+	m        sync.Mutex
+	wg       sync.WaitGroup
+	config   *Config
+	listener net.Listener
+	queue    *queue.Queue
+	log      *logrus.Entry
+	sessions map[*session]bool
+	draining bool
 }
 
-// run continuously delivers
+// run continuously accepts new connections, handling each in a separate
+// goroutine, until the listener is closed.
 func (s *Server) run() {
-	for m := range s.server.NewMessage {
-		s.log.Info("email received via SMTP")
-		raw := email.Raw{
-			From: m.From,
-			To:   m.To,
-			Body: m.Body,
-		}
-		if err := raw.DeliverToQueue(s.queue); err != nil {
-			s.log.Error(err.Error())
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
 		}
+		sess := newSession(s, c)
+		s.m.Lock()
+		s.sessions[sess] = true
+		s.m.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			sess.run()
+			s.m.Lock()
+			delete(s.sessions, sess)
+			s.m.Unlock()
+		}()
 	}
 }
 
 // New creates a new SMTP server with the specified configuration.
 func New(c *Config, q *queue.Queue) (*Server, error) {
-	server, err := smtpsrv.NewServer(c.smtpsrvConfig())
+	l, err := net.Listen("tcp", c.Addr)
 	if err != nil {
 		return nil, err
 	}
 	s := &Server{
-		server: server,
-		queue:  q,
-		log:    logrus.WithField("context", "SMTP"),
+		config:   c,
+		listener: l,
+		queue:    q,
+		log:      logrus.WithField("context", "SMTP"),
+		sessions: make(map[*session]bool),
 	}
+	s.wg.Add(1)
 	go s.run()
 	return s, nil
 }
 
-// Close shuts down the server.
+// getConfig returns the current configuration.
+func (s *Server) getConfig() *Config {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.config
+}
+
+// PrepareReload validates the specified configuration, returning a function
+// that applies it to new commands. Nothing is changed until the function is
+// called. The address cannot be changed while the server is running.
+func (s *Server) PrepareReload(c *Config) (func(), error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	n := *c
+	return func() {
+		s.m.Lock()
+		defer s.m.Unlock()
+		if n.Addr != s.config.Addr {
+			s.log.Warning("address cannot be changed without a restart")
+			n.Addr = s.config.Addr
+		}
+		s.config = &n
+		s.log.Info("configuration reloaded")
+	}, nil
+}
+
+// Reload applies the specified configuration to new commands.
+func (s *Server) Reload(c *Config) error {
+	apply, err := s.PrepareReload(c)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Drain stops accepting new connections and mail. Idle clients are
+// disconnected while clients in the middle of a transaction are given up to the
+// specified amount of time to finish before the server is closed.
+func (s *Server) Drain(timeout time.Duration) {
+	s.log.Info("draining connections")
+	s.listener.Close()
+	s.m.Lock()
+	s.draining = true
+	for sess := range s.sessions {
+		if !sess.busy {
+			sess.conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.m.Unlock()
+	done := make(chan bool)
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.log.Warning("timed out waiting for transactions to finish")
+		s.Close()
+	}
+}
+
+// beginTransaction marks the session as being in the middle of a transaction.
+// False is returned if the server is draining and no new transactions may be
+// started.
+func (s *Server) beginTransaction(sess *session) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.draining {
+		return false
+	}
+	sess.busy = true
+	return true
+}
+
+// endTransaction marks the session as idle. True is returned if the server is
+// draining and the session should be closed.
+func (s *Server) endTransaction(sess *session) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sess.busy = false
+	return s.draining
+}
+
+// isDraining determines whether the server is draining.
+func (s *Server) isDraining() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.draining
+}
+
+// Close shuts down the server, closing any open connections.
 func (s *Server) Close() {
-	s.server.Close(false)
+	s.listener.Close()
+	s.m.Lock()
+	for sess := range s.sessions {
+		sess.conn.Close()
+	}
+	s.m.Unlock()
+	s.wg.Wait()
 }
@@ -0,0 +1,336 @@
+package smtp
+
+import (
+	"github.com/hectane/hectane/queue"
+
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a queue and SMTP server using the specified queue config.
+func createServer(c *queue.Config) (*Server, *queue.Queue, error) {
+	q, err := queue.NewQueue(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := New(&Config{
+		Addr:        "127.0.0.1:0",
+		ReadTimeout: 10,
+	}, q)
+	if err != nil {
+		q.Stop()
+		return nil, nil, err
+	}
+	return s, q, nil
+}
+
+func TestServerDeliver(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	if err := smtp.SendMail(
+		s.Addr().String(),
+		nil,
+		"me@example.invalid",
+		[]string{"you@example.invalid"},
+		[]byte("Subject: Test\r\n\r\nTest\r\n"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := q.Storage.Usage(); messages != 1 {
+		t.Fatalf("%d != 1", messages)
+	}
+}
+
+func TestServerBackpressure(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory:    d,
+		MinFreeBytes: 1 << 62,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Mail("me@example.invalid")
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 452 {
+		t.Fatalf("452 expected, got %v", err)
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	idle, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	busy, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if err := idle.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := busy.Mail("me@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		s.Drain(10 * time.Second)
+		close(done)
+	}()
+	for !s.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := idle.Noop(); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := busy.Rcpt("you@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := busy.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: Test\r\n\r\nTest\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for drain")
+	}
+}
+
+func TestServerBounce(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory:    d,
+		BounceDomain: "bounce.example.invalid",
+		BounceSecret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	if err := smtp.SendMail(
+		s.Addr().String(),
+		nil,
+		"",
+		[]string{queue.VERPAddress("bounce.example.invalid", "secret", "1234", "you@example.invalid")},
+		[]byte("Subject: Undeliverable\r\n\r\n550 5.1.1 User unknown\r\n"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := q.Storage.Usage(); messages != 0 {
+		t.Fatalf("%d != 0", messages)
+	}
+}
+
+func TestServerSuppressed(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	if _, err := q.Storage.Suppress("you@example.invalid", "test"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Rcpt("you@example.invalid")
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 550 {
+		t.Fatalf("550 expected, got %v", err)
+	}
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	if err := s.Reload(&Config{
+		Addr:           s.getConfig().Addr,
+		MaxMessageSize: 16,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, size := c.Extension("SIZE"); !ok || size != "16" {
+		t.Fatalf("%s != 16", size)
+	}
+	if err := c.Mail("me@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("you@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("Subject: Test\r\n\r\nThis message is too long\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 552 {
+		t.Fatalf("552 expected, got %v", err)
+	}
+	id, err := c.Text.Cmd("MAIL FROM:<me@example.invalid> SIZE=17")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 552 {
+		t.Fatalf("552 expected, got %v", err)
+	}
+	if messages, _ := q.Storage.Usage(); messages != 0 {
+		t.Fatalf("%d != 0", messages)
+	}
+}
+
+func TestServerLineTooLong(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id, err := c.Text.Cmd("NOOP %s", strings.Repeat("x", 10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	c.Text.EndResponse(id)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 500 {
+		t.Fatalf("500 expected, got %v", err)
+	}
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTooManyRecipients(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	s, q, err := createServer(&queue.Config{
+		Directory: d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+	defer s.Close()
+	c, err := smtp.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("me@example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxRecipients; i++ {
+		if err := c.Rcpt(fmt.Sprintf("you%d@example.invalid", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Rcpt("another@example.invalid")
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 452 {
+		t.Fatalf("452 expected, got %v", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+}
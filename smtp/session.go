@@ -0,0 +1,360 @@
+package smtp
+
+import (
+	"github.com/hectane/hectane/email"
+	"github.com/hectane/hectane/queue"
+	"github.com/sirupsen/logrus"
+
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLineLength is the maximum length of a command line, including the line
+// break. This allows for extensions adding parameters to the 512 octets
+// permitted by RFC 5321.
+const maxLineLength = 1000
+
+// maxRecipients is the maximum number of recipients in a single transaction,
+// which is the minimum that RFC 5321 requires servers to accept. Clients are
+// expected to send the remaining recipients in another transaction.
+const maxRecipients = 100
+
+var (
+	errInvalidPath = errors.New("invalid path")
+	errLineTooLong = errors.New("line too long")
+)
+
+// session represents a single connection from an SMTP client.
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+	log    *logrus.Entry
+	from   *string
+	to     []string
+	busy   bool
+}
+
+// newSession creates a new session for the specified connection.
+func newSession(s *Server, c net.Conn) *session {
+	return &session{
+		server: s,
+		conn:   c,
+		text:   textproto.NewConn(c),
+		log:    s.log.WithField("remote", c.RemoteAddr().String()),
+	}
+}
+
+// parsePath extracts the address from a MAIL or RCPT argument, which must
+// begin with the specified prefix. Any parameters after the path are ignored.
+func parsePath(arg, prefix string) (string, error) {
+	if !strings.HasPrefix(strings.ToUpper(arg), prefix) {
+		return "", errInvalidPath
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", errInvalidPath
+	}
+	i := strings.Index(arg, ">")
+	if i == -1 {
+		return "", errInvalidPath
+	}
+	return arg[1:i], nil
+}
+
+// parseSize extracts the value of the SIZE parameter (RFC 1870) from a MAIL
+// argument, returning zero if it is not present or invalid.
+func parseSize(arg string) int64 {
+	i := strings.Index(arg, ">")
+	if i == -1 {
+		return 0
+	}
+	for _, p := range strings.Fields(arg[i+1:]) {
+		if strings.HasPrefix(strings.ToUpper(p), "SIZE=") {
+			n, _ := strconv.ParseInt(p[5:], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// readLine reads a single command line from the client. Lines exceeding the
+// maximum length are discarded without being buffered and errLineTooLong is
+// returned.
+func (s *session) readLine() (string, error) {
+	var (
+		line    []byte
+		tooLong bool
+	)
+	for {
+		l, err := s.text.R.ReadSlice('\n')
+		if len(line)+len(l) > maxLineLength {
+			tooLong = true
+			line = nil
+		} else if !tooLong {
+			line = append(line, l...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reply sends a response to the client. Multiple lines of text result in a
+// multiline response.
+func (s *session) reply(code int, lines ...string) error {
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := s.text.PrintfLine("%d%s%s", code, sep, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendDeadline allows the client the configured amount of time to send the
+// next command or message body.
+func (s *session) extendDeadline() {
+	if t := s.server.getConfig().readTimeout(); t > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(t))
+	}
+}
+
+// reset clears the current transaction. False is returned if the server is
+// draining and the session should be closed.
+func (s *session) reset() bool {
+	s.from = nil
+	s.to = nil
+	return !s.server.endTransaction(s)
+}
+
+// shutdown informs the client that the server is shutting down.
+func (s *session) shutdown() error {
+	return s.reply(421, "4.3.2 Service shutting down")
+}
+
+// checkCapacity determines whether the queue is able to accept mail. If not,
+// a transient error is sent to the client and false is returned.
+func (s *session) checkCapacity() (bool, error) {
+	err := s.server.queue.CheckCapacity()
+	if err == nil {
+		return true, nil
+	}
+	s.log.Warning(err.Error())
+	if _, ok := err.(*queue.CapacityError); ok {
+		return false, s.reply(452, "4.3.1 Insufficient system storage")
+	}
+	return false, s.reply(451, "4.3.0 Unable to accept mail")
+}
+
+// data reads the message body and delivers it to the queue. Messages larger
+// than the maximum size are read to the end and discarded.
+func (s *session) data() error {
+	if err := s.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+	s.extendDeadline()
+	var (
+		maxSize = s.server.getConfig().maxMessageSize()
+		r       = s.text.DotReader()
+	)
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxSize {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+		return s.reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+	}
+	s.log.Info("email received via SMTP")
+	var bounces, to []string
+	for _, t := range s.to {
+		if s.server.queue.IsBounceAddress(t) {
+			bounces = append(bounces, t)
+		} else {
+			to = append(to, t)
+		}
+	}
+	if len(bounces) != 0 {
+		if _, err := s.server.queue.ProcessBounce(bounces, body); err != nil {
+			s.log.Errorf("unable to process bounce: %s", err)
+			if len(to) == 0 {
+				return s.reply(451, "4.3.0 Unable to process bounce")
+			}
+		}
+		if len(to) == 0 {
+			return s.reply(250, "2.0.0 Bounce processed")
+		}
+	}
+	if sealed, err := s.server.queue.DKIM.Seal(to, body); err != nil {
+		s.log.Warningf("unable to add ARC set: %s", err)
+	} else {
+		body = sealed
+	}
+	raw := email.Raw{
+		From: *s.from,
+		To:   to,
+		Body: string(body),
+	}
+	if _, _, err := raw.DeliverToQueue(s.server.queue); err != nil {
+		s.log.Error(err.Error())
+		return s.reply(451, "4.3.0 Unable to queue message")
+	}
+	return s.reply(250, "2.0.0 Message queued")
+}
+
+// endTransaction replies to the client and ends the current transaction. If
+// the server is draining, the client is disconnected.
+func (s *session) endTransaction(code int, lines ...string) (bool, error) {
+	if err := s.reply(code, lines...); err != nil {
+		return false, err
+	}
+	if !s.reset() {
+		return false, s.shutdown()
+	}
+	return true, nil
+}
+
+// command processes a single command from the client. The returned boolean
+// indicates whether the session should continue.
+func (s *session) command(line string) (bool, error) {
+	var (
+		parts = strings.SplitN(line, " ", 2)
+		verb  = strings.ToUpper(parts[0])
+		arg   string
+	)
+	if len(parts) == 2 {
+		arg = strings.TrimSpace(parts[1])
+	}
+	switch verb {
+	case "HELO":
+		return s.endTransaction(250, "Hello "+arg)
+	case "EHLO":
+		return s.endTransaction(
+			250,
+			"Hello "+arg,
+			"8BITMIME",
+			fmt.Sprintf("SIZE %d", s.server.getConfig().maxMessageSize()),
+		)
+	case "MAIL":
+		if s.from != nil {
+			return true, s.reply(503, "5.5.1 Nested MAIL command")
+		}
+		from, err := parsePath(arg, "FROM:")
+		if err != nil {
+			return true, s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		}
+		if parseSize(arg) > s.server.getConfig().maxMessageSize() {
+			return true, s.reply(552, "5.3.4 Message size exceeds fixed maximum message size")
+		}
+		if !s.server.beginTransaction(s) {
+			return false, s.shutdown()
+		}
+		if ok, err := s.checkCapacity(); !ok {
+			s.reset()
+			return true, err
+		}
+		s.from = &from
+		return true, s.reply(250, "2.1.0 OK")
+	case "RCPT":
+		if s.from == nil {
+			return true, s.reply(503, "5.5.1 Need MAIL command")
+		}
+		to, err := parsePath(arg, "TO:")
+		if err != nil || to == "" {
+			return true, s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		}
+		if len(s.to) >= maxRecipients {
+			return true, s.reply(452, "4.5.3 Too many recipients")
+		}
+		if ok, err := s.checkCapacity(); !ok {
+			return true, err
+		}
+		if suppressed, err := s.server.queue.Storage.IsSuppressed(to); err != nil {
+			s.log.Error(err.Error())
+			return true, s.reply(451, "4.3.0 Unable to check recipient")
+		} else if suppressed {
+			return true, s.reply(550, "5.1.1 Recipient is suppressed")
+		}
+		s.to = append(s.to, to)
+		return true, s.reply(250, "2.1.5 OK")
+	case "DATA":
+		if len(s.to) == 0 {
+			return true, s.reply(503, "5.5.1 Need RCPT command")
+		}
+		if err := s.data(); err != nil {
+			return false, err
+		}
+		if !s.reset() {
+			return false, s.shutdown()
+		}
+		return true, nil
+	case "RSET":
+		return s.endTransaction(250, "2.0.0 OK")
+	case "NOOP":
+		return true, s.reply(250, "2.0.0 OK")
+	case "VRFY":
+		return true, s.reply(252, "2.5.2 Cannot verify user")
+	case "QUIT":
+		return false, s.reply(221, "2.0.0 Bye")
+	default:
+		return true, s.reply(502, "5.5.2 Command not recognized")
+	}
+}
+
+// run processes commands from the client until the connection is closed.
+func (s *session) run() {
+	defer s.text.Close()
+	s.log.Debug("connection established")
+	if err := s.reply(220, s.server.getConfig().banner()+" ESMTP"); err != nil {
+		return
+	}
+	for {
+		// The deadline must be extended before checking whether the server
+		// is draining so that Drain() is able to interrupt the read
+		s.extendDeadline()
+		if !s.busy && s.server.isDraining() {
+			s.shutdown()
+			break
+		}
+		line, err := s.readLine()
+		if err == errLineTooLong {
+			if err := s.reply(500, "5.5.2 Line too long"); err != nil {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			if s.server.isDraining() {
+				s.shutdown()
+			}
+			break
+		}
+		cont, err := s.command(line)
+		if err != nil || !cont {
+			break
+		}
+	}
+	s.log.Debug("connection closed")
+}